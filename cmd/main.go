@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -38,6 +39,14 @@ var (
 	logEnv               = kingpin.Flag("log.env", "If true, environment variables passed to a script will be logged.").Default().Bool()
 	scriptNoArgs         = kingpin.Flag("script.no-args", "Restrict script to accept arguments.").Default().Bool()
 	scriptTimeoutOffset  = kingpin.Flag("script.timeout-offset", "Offset to subtract from timeout in seconds.").Default("0.5").Float64()
+	scriptMaxParallel    = kingpin.Flag("script.max-parallel", "Maximum number of scripts which are run in parallel within a single probe. 0 means no limit.").Default("0").Int()
+	scriptMaxConcurrency = kingpin.Flag("script.max-concurrency", "Maximum number of scripts which are run at the same time across all probes. 0 means no limit.").Default("0").Int()
+	scriptQueueSize      = kingpin.Flag("script.queue-size", "Maximum number of script executions which are waiting for a free slot, when the --script.max-concurrency limit is reached.").Default("0").Int()
+	cacheMaxEntries      = kingpin.Flag("cache.max-entries", "Maximum number of entries in the cache. If the limit is reached, the least recently used entries are evicted. 0 means no limit.").Default("1000").Int()
+	cacheMaxBytes        = kingpin.Flag("cache.max-bytes", "Maximum estimated size of all entries in the cache in bytes. If the limit is reached, the least recently used entries are evicted. 0 means no limit.").Default("0").Int64()
+	cacheDir             = kingpin.Flag("cache.dir", "Directory to persist the cache, so that it is restored after a restart. If not set, the cache is only kept in memory.").Default("").String()
+	historyLimit         = kingpin.Flag("history.limit", "Number of probe executions per script, which are kept in the history. 0 disables the history.").Default("10").Int()
+	historyRedactParams  = kingpin.Flag("history.redact-params", "Comma-separated list of parameters, which values are not kept in the history, e.g. because they contain secrets.").Default("").String()
 	externalURL          = kingpin.Flag("web.external-url", "The URL under which Script Exporter is externally reachable (for example, if Script Exporter is served via a reverse proxy). Used for generating relative and absolute links back to Script Exporter itself. If the URL has a path portion, it will be used to prefix all HTTP endpoints served by Script Exporter. If omitted, relevant URL components will be derived automatically.").PlaceHolder("<url>").String()
 	routePrefix          = kingpin.Flag("web.route-prefix", "Prefix for the internal routes of web endpoints. Defaults to path of --web.external-url.").PlaceHolder("<path>").String()
 	discoveryHost        = kingpin.Flag("discovery.host", "Host for service discovery.").Default("").String()
@@ -74,6 +83,39 @@ func run(stopCh chan bool) int {
 
 	logger.Info("Loaded config files")
 
+	prober.SetupResources(sc.C, logger)
+
+	prober.SetCacheLimits(*cacheMaxEntries, *cacheMaxBytes)
+	if *cacheDir != "" {
+		if err := prober.SetCacheDir(*cacheDir, logger); err != nil {
+			logger.Error("Error loading cache", "err", err)
+			return 1
+		}
+	}
+	prober.SetHistoryLimit(*historyLimit)
+	if *historyRedactParams != "" {
+		prober.SetHistoryRedactParams(strings.Split(*historyRedactParams, ","))
+	}
+	prober.SetMaxConcurrency(*scriptMaxConcurrency, *scriptQueueSize)
+	prometheus.MustRegister(prober.NewScheduleCollector(logger))
+	prober.UpdateSchedules(sc.C, logger, *logEnv, *scriptTimeoutOffset, *scriptNoArgs)
+
+	// reloadConfig reloads the configuration files and updates the resources
+	// and the schedules of the scripts, so that they are always matching the
+	// loaded configuration.
+	reloadConfig := func() error {
+		if err := sc.ReloadConfig(*configFiles, logger); err != nil {
+			return err
+		}
+
+		sc.RLock()
+		prober.SetupResources(sc.C, logger)
+		prober.UpdateSchedules(sc.C, logger, *logEnv, *scriptTimeoutOffset, *scriptNoArgs)
+		sc.RUnlock()
+
+		return nil
+	}
+
 	// Infer or set Script Exporter externalURL
 	listenAddrs := toolkitFlags.WebListenAddresses
 	if *externalURL == "" && *toolkitFlags.WebSystemdSocket {
@@ -110,19 +152,19 @@ func run(stopCh chan bool) int {
 		for {
 			select {
 			case <-time.After(*configReloadInterval):
-				if err := sc.ReloadConfig(*configFiles, logger); err != nil {
+				if err := reloadConfig(); err != nil {
 					logger.Error("Error reloading config", "err", err)
 					continue
 				}
 				logger.Info("Reloaded config file", "after", *configReloadInterval)
 			case <-hup:
-				if err := sc.ReloadConfig(*configFiles, logger); err != nil {
+				if err := reloadConfig(); err != nil {
 					logger.Error("Error reloading config", "err", err)
 					continue
 				}
 				logger.Info("Reloaded config file")
 			case rc := <-reloadCh:
-				if err := sc.ReloadConfig(*configFiles, logger); err != nil {
+				if err := reloadConfig(); err != nil {
 					logger.Error("Error reloading config", "err", err)
 					rc <- err
 				} else {
@@ -159,7 +201,21 @@ func run(stopCh chan bool) int {
 				http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
 			}
 		})
-	http.Handle(path.Join(*routePrefix, "/metrics"), promhttp.Handler())
+	http.HandleFunc(path.Join(*routePrefix, "/-/cache"), func(w http.ResponseWriter, r *http.Request) {
+		prober.CacheHandler(w, r, logger)
+	})
+	http.HandleFunc(path.Join(*routePrefix, "/-/cache/invalidate"), func(w http.ResponseWriter, r *http.Request) {
+		sc.RLock()
+		config := sc.C
+		sc.RUnlock()
+		prober.CacheInvalidateHandler(w, r, config, logger, *scriptNoArgs)
+	})
+	// Errors while gathering the metrics, e.g. because of invalid metrics of a
+	// scheduled script, do not fail the whole endpoint.
+	http.Handle(path.Join(*routePrefix, "/metrics"), promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		ErrorLog:      slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ErrorHandling: promhttp.ContinueOnError,
+	})))
 	http.HandleFunc(path.Join(*routePrefix, "/-/healthy"), func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Healthy"))
@@ -168,7 +224,13 @@ func run(stopCh chan bool) int {
 		sc.Lock()
 		config := sc.C
 		sc.Unlock()
-		prober.Handler(w, r, config, logger, *logEnv, *scriptTimeoutOffset, *scriptNoArgs)
+		prober.Handler(w, r, config, logger, *logEnv, *scriptTimeoutOffset, *scriptNoArgs, *scriptMaxParallel)
+	})
+	http.HandleFunc(path.Join(*routePrefix, "/history"), func(w http.ResponseWriter, r *http.Request) {
+		prober.HistoryHandler(w, r, logger)
+	})
+	http.HandleFunc(path.Join(*routePrefix, "/api/v1/history"), func(w http.ResponseWriter, r *http.Request) {
+		prober.HistoryAPIHandler(w, r, logger)
 	})
 	http.HandleFunc(path.Join(*routePrefix, "/discovery"), func(w http.ResponseWriter, r *http.Request) {
 		sc.Lock()
@@ -186,6 +248,7 @@ func run(stopCh chan bool) int {
 		<li><a href='/metrics'>Metrics</a></li>
 		<li><a href='/probe'>Probe</a></li>
 		<li><a href='/config'>Config</a></li>
+		<li><a href='/history'>History</a></li>
 		</ul>
 		<ul>
 		<li>version: ` + version.Version + `</li>
@@ -232,9 +295,11 @@ func run(stopCh chan bool) int {
 		select {
 		case <-stopCh:
 			logger.Info("Service received stop message...")
+			prober.FlushCache()
 			return 0
 		case <-term:
 			logger.Info("Received SIGTERM, exiting gracefully...")
+			prober.FlushCache()
 			return 0
 		case <-srvc:
 			return 1
@@ -8,12 +8,15 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"text/template"
 
 	"github.com/goccy/go-yaml"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
 )
 
 type Config struct {
@@ -30,37 +33,166 @@ func (c *Config) GetScript(name string) *Script {
 	return nil
 }
 
+// KillSignals are the names of the signals, which can be used to terminate a
+// script, when the timeout is enforced.
+var KillSignals = []string{"SIGTERM", "SIGINT", "SIGHUP", "SIGQUIT", "SIGUSR1", "SIGUSR2", "SIGKILL"}
+
+// validate checks the configuration for values, which are syntactically valid
+// YAML, but can not be used by the exporter.
+func (c *Config) validate() error {
+	for _, script := range c.Scripts {
+		for name, value := range script.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") || name == "script" {
+				return fmt.Errorf("script %s: invalid label name %q", script.Name, name)
+			}
+			if _, err := template.New(name).Parse(value); err != nil {
+				return fmt.Errorf("script %s: invalid template for label %s: %s", script.Name, name, err)
+			}
+		}
+
+		if script.Output.Influx.StringFields != "" && script.Output.Influx.StringFields != "label" && script.Output.Influx.StringFields != "drop" {
+			return fmt.Errorf("script %s: invalid value %q for influx string fields", script.Name, script.Output.Influx.StringFields)
+		}
+
+		if script.Timeout.KillSignal != "" && !slices.Contains(KillSignals, script.Timeout.KillSignal) {
+			return fmt.Errorf("script %s: invalid value %q for timeout kill signal", script.Name, script.Timeout.KillSignal)
+		}
+		if script.Timeout.GracePeriod != nil && *script.Timeout.GracePeriod < 0 {
+			return fmt.Errorf("script %s: grace period of timeout must not be negative", script.Name)
+		}
+
+		if script.Resources.MemoryMax < 0 || script.Resources.CPUQuota < 0 || script.Resources.PidsMax < 0 {
+			return fmt.Errorf("script %s: resource limits must not be negative", script.Name)
+		}
+
+		if script.MaxConcurrency < 0 || script.Queue.Size < 0 {
+			return fmt.Errorf("script %s: max concurrency and queue size must not be negative", script.Name)
+		}
+		if script.Queue.OnFull != "" && script.Queue.OnFull != "reject" && script.Queue.OnFull != "stale" && script.Queue.OnFull != "wait" {
+			return fmt.Errorf("script %s: invalid value %q for queue on full", script.Name, script.Queue.OnFull)
+		}
+
+		if script.Cache.StaleWhileRevalidate < 0 {
+			return fmt.Errorf("script %s: stale while revalidate of cache must not be negative", script.Name)
+		}
+		if script.Cache.StaleWhileRevalidate > 0 && script.Cache.Duration == nil {
+			return fmt.Errorf("script %s: duration of cache is missing", script.Name)
+		}
+
+		if script.Schedule.Interval < 0 || script.Schedule.Jitter < 0 {
+			return fmt.Errorf("script %s: interval and jitter of schedule must not be negative", script.Name)
+		}
+		if script.Schedule.Interval == 0 && (script.Schedule.Jitter > 0 || len(script.Schedule.Params) > 0 || script.Schedule.ExposeMetrics) {
+			return fmt.Errorf("script %s: interval of schedule is missing", script.Name)
+		}
+		if script.Schedule.ExposeMetrics && len(script.Schedule.Params) > 1 {
+			return fmt.Errorf("script %s: metrics of schedule can only be exposed for a single set of parameters", script.Name)
+		}
+
+		for _, metric := range script.Output.JSON {
+			if metric.Name == "" {
+				return fmt.Errorf("script %s: name of json metric is missing", script.Name)
+			}
+			if !model.IsValidMetricName(model.LabelValue(metric.Name)) {
+				return fmt.Errorf("script %s: invalid name %q for json metric", script.Name, metric.Name)
+			}
+			if metric.Path == "" {
+				return fmt.Errorf("script %s: path of json metric %s is missing", script.Name, metric.Name)
+			}
+			if metric.Type != "" && metric.Type != "gauge" && metric.Type != "counter" && metric.Type != "untyped" {
+				return fmt.Errorf("script %s: invalid type %q for json metric %s", script.Name, metric.Type, metric.Name)
+			}
+			for name := range metric.Labels {
+				if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+					return fmt.Errorf("script %s: invalid label name %q for json metric %s", script.Name, name, metric.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 type Script struct {
-	Name              string            `yaml:"name"`
-	Command           []string          `yaml:"command"`
-	Args              []string          `yaml:"args"`
-	Env               map[string]string `yaml:"env"`
-	AllowEnvOverwrite bool              `yaml:"allow_env_overwrite"`
-	Sudo              bool              `yaml:"sudo"`
-	Output            Output            `yaml:"output"`
-	Timeout           Timeout           `yaml:"timeout"`
-	Cache             Cache             `yaml:"cache"`
-	Discovery         Discovery         `yaml:"discovery"`
+	Name                 string            `yaml:"name"`
+	Command              []string          `yaml:"command"`
+	Args                 []string          `yaml:"args"`
+	Env                  map[string]string `yaml:"env"`
+	AllowEnvOverwrite    bool              `yaml:"allow_env_overwrite"`
+	Sudo                 bool              `yaml:"sudo"`
+	Labels               map[string]string `yaml:"labels"`
+	Output               Output            `yaml:"output"`
+	MetricRelabelConfigs []RelabelConfig   `yaml:"metric_relabel_configs"`
+	Timeout              Timeout           `yaml:"timeout"`
+	MaxConcurrency       int               `yaml:"max_concurrency"`
+	Queue                Queue             `yaml:"queue"`
+	Cache                Cache             `yaml:"cache"`
+	Schedule             Schedule          `yaml:"schedule"`
+	Resources            Resources         `yaml:"resources"`
+	Discovery            Discovery         `yaml:"discovery"`
 }
 
 type Output struct {
-	Ignore        bool   `yaml:"ignore"`
-	IgnoreOnError bool   `yaml:"ignore_on_error"`
-	Format        string `yaml:"format"`
+	Ignore        bool         `yaml:"ignore"`
+	IgnoreOnError bool         `yaml:"ignore_on_error"`
+	Format        string       `yaml:"format"`
+	JSON          []JSONMetric `yaml:"json"`
+	Influx        Influx       `yaml:"influx"`
+}
+
+type JSONMetric struct {
+	Name   string            `yaml:"name"`
+	Help   string            `yaml:"help"`
+	Type   string            `yaml:"type"`
+	Path   string            `yaml:"path"`
+	Labels map[string]string `yaml:"labels"`
+	Value  string            `yaml:"value"`
+}
+
+type Influx struct {
+	StringFields string `yaml:"string_fields"`
 }
 
 type Timeout struct {
-	MaxTimeout float64 `yaml:"max_timeout"`
-	Enforced   bool    `yaml:"enforced"`
-	WaitDelay  float64 `yaml:"wait_delay"`
+	MaxTimeout         float64  `yaml:"max_timeout"`
+	Enforced           bool     `yaml:"enforced"`
+	WaitDelay          float64  `yaml:"wait_delay"`
+	KillSignal         string   `yaml:"kill_signal"`
+	GracePeriod        *float64 `yaml:"grace_period"`
+	CancelOnDisconnect bool     `yaml:"cancel_on_disconnect"`
+}
+
+type Resources struct {
+	MemoryMax    int64   `yaml:"memory_max"`
+	CPUQuota     float64 `yaml:"cpu_quota"`
+	PidsMax      int64   `yaml:"pids_max"`
+	MaxOpenFiles uint64  `yaml:"max_open_files"`
+}
+
+// IsSet returns true, when at least one resource limit is configured.
+func (r Resources) IsSet() bool {
+	return r.MemoryMax > 0 || r.CPUQuota > 0 || r.PidsMax > 0 || r.MaxOpenFiles > 0
+}
+
+type Queue struct {
+	Size   int    `yaml:"size"`
+	OnFull string `yaml:"on_full"`
 }
 
 type Cache struct {
 	Duration               *float64 `yaml:"duration"`
+	StaleWhileRevalidate   float64  `yaml:"stale_while_revalidate"`
 	CacheOnError           bool     `yaml:"cache_on_error"`
 	UseExpiredCacheOnError bool     `yaml:"use_expired_cache_on_error"`
 }
 
+type Schedule struct {
+	Interval      float64             `yaml:"interval"`
+	Jitter        float64             `yaml:"jitter"`
+	Params        []map[string]string `yaml:"params"`
+	ExposeMetrics bool                `yaml:"expose_metrics"`
+}
+
 type Discovery struct {
 	Params         map[string]string `yaml:"params"`
 	ScrapeInterval string            `yaml:"scrape_interval"`
@@ -132,6 +264,10 @@ func (sc *SafeConfig) reloadConfigFromFiles(configFiles string) (err error) {
 		c.Scripts = append(c.Scripts, fc.Scripts...)
 	}
 
+	if err = c.validate(); err != nil {
+		return fmt.Errorf("error validating config file: %s", err)
+	}
+
 	sc.Lock()
 	sc.C = c
 	sc.Unlock()
@@ -167,6 +303,10 @@ func (sc *SafeConfig) reloadConfigFromUrl(configFiles string) (err error) {
 		return fmt.Errorf("error parsing config file: %w", err)
 	}
 
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("error validating config file: %w", err)
+	}
+
 	sc.Lock()
 	sc.C = &c
 	sc.Unlock()
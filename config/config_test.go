@@ -25,6 +25,19 @@ func TestNewSafeConfig(t *testing.T) {
 			require.Equal(t, "output", script.Name)
 		})
 
+		t.Run("should set default values for relabel configs", func(t *testing.T) {
+			script := sc.C.GetScript("output")
+			require.NotNil(t, script)
+			require.Len(t, script.MetricRelabelConfigs, 2)
+			require.Equal(t, RelabelDrop, script.MetricRelabelConfigs[0].Action)
+			require.True(t, script.MetricRelabelConfigs[0].Regex.MatchString("second_test"))
+			require.False(t, script.MetricRelabelConfigs[0].Regex.MatchString("first_second_test"))
+			require.Equal(t, RelabelReplace, script.MetricRelabelConfigs[1].Action)
+			require.Equal(t, ";", script.MetricRelabelConfigs[1].Separator)
+			require.Equal(t, "$1", script.MetricRelabelConfigs[1].Replacement)
+			require.Equal(t, "(.*)", script.MetricRelabelConfigs[1].Regex.String())
+		})
+
 		t.Run("should return nil if script is not found", func(t *testing.T) {
 			script := sc.C.GetScript("invalid")
 			require.Nil(t, script)
@@ -37,6 +50,62 @@ func TestNewSafeConfig(t *testing.T) {
 
 		require.Error(t, err)
 	})
+
+	t.Run("should return error for invalid relabel configuration", func(t *testing.T) {
+		sc := NewSafeConfig(prometheus.NewRegistry())
+		err := sc.ReloadConfig("./testdata/config-invalid-relabel.yaml", slog.Default())
+
+		require.Error(t, err)
+	})
+
+	t.Run("should return error for invalid labels", func(t *testing.T) {
+		sc := NewSafeConfig(prometheus.NewRegistry())
+		err := sc.ReloadConfig("./testdata/config-invalid-labels.yaml", slog.Default())
+
+		require.Error(t, err)
+	})
+
+	t.Run("should return error for invalid json output configuration", func(t *testing.T) {
+		sc := NewSafeConfig(prometheus.NewRegistry())
+		err := sc.ReloadConfig("./testdata/config-invalid-json.yaml", slog.Default())
+
+		require.ErrorContains(t, err, `invalid label name "__name__" for json metric example_value`)
+	})
+
+	t.Run("should return error for invalid json metric type", func(t *testing.T) {
+		sc := NewSafeConfig(prometheus.NewRegistry())
+		err := sc.ReloadConfig("./testdata/config-invalid-json-type.yaml", slog.Default())
+
+		require.ErrorContains(t, err, `invalid type "histogram" for json metric example_value`)
+	})
+
+	t.Run("should return error for invalid schedule", func(t *testing.T) {
+		sc := NewSafeConfig(prometheus.NewRegistry())
+		err := sc.ReloadConfig("./testdata/config-invalid-schedule.yaml", slog.Default())
+
+		require.Error(t, err)
+	})
+
+	t.Run("should return error for invalid queue", func(t *testing.T) {
+		sc := NewSafeConfig(prometheus.NewRegistry())
+		err := sc.ReloadConfig("./testdata/config-invalid-queue.yaml", slog.Default())
+
+		require.Error(t, err)
+	})
+
+	t.Run("should return error for invalid timeout", func(t *testing.T) {
+		sc := NewSafeConfig(prometheus.NewRegistry())
+		err := sc.ReloadConfig("./testdata/config-invalid-timeout.yaml", slog.Default())
+
+		require.Error(t, err)
+	})
+
+	t.Run("should return error for invalid resources", func(t *testing.T) {
+		sc := NewSafeConfig(prometheus.NewRegistry())
+		err := sc.ReloadConfig("./testdata/config-invalid-resources.yaml", slog.Default())
+
+		require.Error(t, err)
+	})
 }
 
 func TestNewSafeConfigFromUrl(t *testing.T) {
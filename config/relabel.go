@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// The supported actions for a relabel configuration. They are using the same
+// semantic as the actions for the relabel configurations in Prometheus.
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+)
+
+// DefaultRelabelConfig contains the default values for a relabel configuration,
+// which are used for all fields which are not set in the configuration file.
+var DefaultRelabelConfig = RelabelConfig{
+	Separator:   ";",
+	Regex:       MustNewRegexp("(.*)"),
+	Replacement: "$1",
+	Action:      RelabelReplace,
+}
+
+// RelabelConfig is the configuration to relabel or filter the metrics from the
+// output of a script, similar to the "metric_relabel_configs" in Prometheus.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        Regexp   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
+
+// UnmarshalYAML sets the default values for all fields of the relabel
+// configuration, which are not set in the configuration file and validates the
+// configuration.
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	*c = DefaultRelabelConfig
+
+	type plain RelabelConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	switch c.Action {
+	case RelabelReplace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel configuration for %s action requires 'target_label' value", c.Action)
+		}
+	case RelabelKeep, RelabelDrop, RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+
+	return nil
+}
+
+// Regexp is a regular expression, which is anchored at the beginning and the
+// end of the matched string, like the regular expressions in the relabel
+// configurations of Prometheus.
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+// NewRegexp creates a new anchored regular expression.
+func NewRegexp(s string) (Regexp, error) {
+	regex, err := regexp.Compile("^(?s:" + s + ")$")
+	if err != nil {
+		return Regexp{}, err
+	}
+
+	return Regexp{Regexp: regex, original: s}, nil
+}
+
+// MustNewRegexp works like NewRegexp, but panics if the regular expression can
+// not be compiled.
+func MustNewRegexp(s string) Regexp {
+	regex, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return regex
+}
+
+// UnmarshalYAML compiles the regular expression from the configuration file.
+func (re *Regexp) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	regex, err := NewRegexp(s)
+	if err != nil {
+		return err
+	}
+
+	*re = regex
+	return nil
+}
+
+// String returns the original regular expression without the anchors.
+func (re Regexp) String() string {
+	return re.original
+}
+
+// MarshalYAML returns the original regular expression, so that it can be shown
+// in the "/config" endpoint.
+func (re Regexp) MarshalYAML() (any, error) {
+	return re.original, nil
+}
@@ -1,44 +1,208 @@
 package prober
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"strings"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/ricoberger/script_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	metricCacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "script_exporter",
+		Name:      "cache_entries",
+		Help:      "Number of entries in the cache, partitioned by script.",
+	}, []string{"script"})
+	metricCacheBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "script_exporter",
+		Name:      "cache_bytes",
+		Help:      "Estimated size of the entries in the cache in bytes, partitioned by script.",
+	}, []string{"script"})
+	metricCacheHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "cache_hits_total",
+		Help:      "Number of script results returned from the cache, partitioned by script.",
+	}, []string{"script"})
+	metricCacheMissesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "cache_misses_total",
+		Help:      "Number of script results which were not found in the cache, partitioned by script.",
+	}, []string{"script"})
+	metricCacheEvictionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "cache_evictions_total",
+		Help:      "Number of entries removed from the cache, partitioned by script and reason (expired, size or invalidated).",
+	}, []string{"script", "reason"})
+	metricCacheRevalidationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "cache_revalidations_total",
+		Help:      "Number of background executions started to refresh a stale result in the cache, partitioned by script.",
+	}, []string{"script"})
+	metricCacheStaleServesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "cache_stale_serves_total",
+		Help:      "Number of expired script results returned from the cache, partitioned by script.",
+	}, []string{"script"})
 )
 
-var cache map[string]cacheEntry
-var cacheLock = sync.RWMutex{}
+// cache contains the results of the scripts, where caching is enabled. The
+// cache is bounded by the maximum number of entries and the maximum size of
+// all entries. When one of the limits is reached, the least recently used
+// entries are evicted. Expired entries are evicted, when they can not be used
+// anymore.
+var cache = struct {
+	entries    map[string]*list.Element
+	lru        *list.List
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+}{
+	entries: make(map[string]*list.Element),
+	lru:     list.New(),
+}
+var cacheLock = sync.Mutex{}
 
 type cacheEntry struct {
-	cacheTime time.Time
-	result    scriptResult
+	key        string
+	scriptName string
+	cacheTime  time.Time
+	expireTime time.Time
+	// staleTime is the time until an expired entry is returned, while the
+	// result is refreshed in the background. It is equal to the expireTime,
+	// when the "stale_while_revalidate" option is not set.
+	staleTime time.Time
+	// keepExpired is true, when the result should be kept after it is expired,
+	// because the script is configured to use the expired cache in some cases.
+	keepExpired bool
+	size        int64
+	result      scriptResult
+}
+
+func (e *cacheEntry) isExpired() bool {
+	return !e.expireTime.After(time.Now())
+}
+
+func (e *cacheEntry) isStale() bool {
+	return !e.staleTime.After(time.Now())
+}
+
+// isRemovable returns true, when the entry can not be used anymore and can be
+// removed from the cache.
+func (e *cacheEntry) isRemovable() bool {
+	return e.isStale() && !e.keepExpired
+}
+
+// SetCacheLimits sets the maximum number of entries and the maximum size in
+// bytes of the cache. If a limit is 0, the cache is not bounded by this limit.
+func SetCacheLimits(maxEntries int, maxBytes int64) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	cache.maxEntries = maxEntries
+	cache.maxBytes = maxBytes
+	evictCacheEntries()
 }
 
-func getCacheKey(script *config.Script, scriptParamValues []string) string {
-	return fmt.Sprintf("%s--%s", script.Name, strings.Join(scriptParamValues, "-"))
+// getCacheKey returns the key for the result of a script execution. The key is
+// also used to deduplicate concurrent executions. It contains the name of the
+// script and a SHA-256 hash of all inputs, which are affecting the execution:
+// The parameter values which are passed as arguments and all query parameters,
+// because they are passed to the script as environment variables. When the
+// cache is enabled for the script, the hash also contains the configuration of
+// the script, so that results from an old configuration are not used anymore
+// after the configuration was changed.
+func getCacheKey(script *config.Script, scriptParamValues []string, params url.Values) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "args=%q params=%q\n", scriptParamValues, params.Encode())
+
+	if script.Cache.Duration != nil {
+		fmt.Fprintf(hash, "command=%q args=%q env=%q allow_env_overwrite=%t sudo=%t labels=%q\n", script.Command, script.Args, script.Env, script.AllowEnvOverwrite, script.Sudo, script.Labels)
+		fmt.Fprintf(hash, "output=%t %t %q %q\n", script.Output.Ignore, script.Output.IgnoreOnError, script.Output.Format, script.Output.Influx.StringFields)
+		for _, m := range script.Output.JSON {
+			fmt.Fprintf(hash, "json=%q %q %q %q %q %q\n", m.Name, m.Help, m.Type, m.Path, m.Labels, m.Value)
+		}
+		for _, c := range script.MetricRelabelConfigs {
+			fmt.Fprintf(hash, "relabel=%q %q %q %q %q %q\n", c.SourceLabels, c.Separator, c.Regex.String(), c.TargetLabel, c.Replacement, c.Action)
+		}
+		fmt.Fprintf(hash, "timeout=%g %t %g %q %s\n", script.Timeout.MaxTimeout, script.Timeout.Enforced, script.Timeout.WaitDelay, script.Timeout.KillSignal, getGracePeriod(script))
+		fmt.Fprintf(hash, "resources=%d %g %d %d\n", script.Resources.MemoryMax, script.Resources.CPUQuota, script.Resources.PidsMax, script.Resources.MaxOpenFiles)
+	}
+
+	return script.Name + "--" + hex.EncodeToString(hash.Sum(nil))
 }
 
-func getCacheResult(script *config.Script, scriptParamValues []string, useExpiredCache bool) *scriptResult {
-	cacheLock.RLock()
-	defer cacheLock.RUnlock()
+// getCacheResultSize returns the estimated size of a script result in bytes.
+func getCacheResultSize(result scriptResult) int64 {
+	size := len(result.stdout) + len(result.stderr) + len(result.err)
+	for _, arg := range result.args {
+		size += len(arg)
+	}
+	for _, envKey := range result.envKeys {
+		size += len(envKey)
+	}
+	for _, validationError := range result.validationErrors {
+		size += len(validationError)
+	}
+	for _, metricFamily := range result.metrics {
+		size += proto.Size(metricFamily)
+	}
+
+	return int64(size)
+}
+
+// getCacheResult returns the cached result for the provided key. If the result
+// is expired, but it can still be returned because of the
+// "stale_while_revalidate" option, the second return value is true and the
+// caller should refresh the result in the background. If useExpiredCache is
+// true, also expired results are returned.
+func getCacheResult(script *config.Script, key string, useExpiredCache bool) (*scriptResult, bool) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
 
 	if script.Cache.Duration == nil {
-		return nil
+		return nil, false
 	}
 
-	if entry, ok := cache[getCacheKey(script, scriptParamValues)]; ok {
-		if entry.cacheTime.Add(time.Duration(*script.Cache.Duration*float64(time.Second))).After(time.Now()) || useExpiredCache {
-			return &entry.result
+	element, ok := cache.entries[key]
+	if !ok {
+		if !useExpiredCache {
+			metricCacheMissesTotal.WithLabelValues(script.Name).Inc()
 		}
+		return nil, false
 	}
 
-	return nil
+	entry := element.Value.(*cacheEntry)
+	if entry.isExpired() {
+		if useExpiredCache || !entry.isStale() {
+			cache.lru.MoveToFront(element)
+			metricCacheStaleServesTotal.WithLabelValues(script.Name).Inc()
+			result := entry.result
+			return &result, !useExpiredCache
+		}
+
+		if entry.isRemovable() {
+			removeCacheEntry(element, "expired")
+		}
+		metricCacheMissesTotal.WithLabelValues(script.Name).Inc()
+		return nil, false
+	}
+
+	cache.lru.MoveToFront(element)
+	metricCacheHitsTotal.WithLabelValues(script.Name).Inc()
+	result := entry.result
+	return &result, false
 }
 
-func setCacheResult(script *config.Script, scriptParamValues []string, result scriptResult) {
+func setCacheResult(script *config.Script, key string, result scriptResult) {
 	cacheLock.Lock()
 	defer cacheLock.Unlock()
 
@@ -46,12 +210,77 @@ func setCacheResult(script *config.Script, scriptParamValues []string, result sc
 		return
 	}
 
-	if cache == nil {
-		cache = make(map[string]cacheEntry)
+	var replacedEntry *cacheEntry
+	if element, ok := cache.entries[key]; ok {
+		replacedEntry = element.Value.(*cacheEntry)
+		removeCacheEntry(element, "")
+	}
+
+	entry := &cacheEntry{
+		key:         key,
+		scriptName:  script.Name,
+		cacheTime:   time.Now(),
+		expireTime:  time.Now().Add(time.Duration(*script.Cache.Duration * float64(time.Second))),
+		staleTime:   time.Now().Add(time.Duration((*script.Cache.Duration + script.Cache.StaleWhileRevalidate) * float64(time.Second))),
+		keepExpired: script.Cache.UseExpiredCacheOnError || script.Queue.OnFull == "stale",
+		size:        getCacheResultSize(result),
+		result:      result,
 	}
 
-	cache[getCacheKey(script, scriptParamValues)] = cacheEntry{
-		cacheTime: time.Now(),
-		result:    result,
+	// A result which is larger than the cache itself is not cached, because it
+	// would evict all other entries. The replaced entry must also be deleted
+	// from the store, so that it isn't loaded again after a restart.
+	if cache.maxBytes > 0 && entry.size > cache.maxBytes {
+		if replacedEntry != nil {
+			deleteCacheEntry(replacedEntry)
+		}
+		return
+	}
+
+	addCacheEntry(entry)
+	saveCacheEntry(entry)
+	evictCacheEntries()
+}
+
+// addCacheEntry adds the provided entry as most recently used entry to the
+// cache. The cache lock must be held by the caller.
+func addCacheEntry(entry *cacheEntry) {
+	cache.entries[entry.key] = cache.lru.PushFront(entry)
+	cache.bytes += entry.size
+	metricCacheEntries.WithLabelValues(entry.scriptName).Inc()
+	metricCacheBytes.WithLabelValues(entry.scriptName).Add(float64(entry.size))
+}
+
+// evictCacheEntries removes all expired entries, which can not be used
+// anymore, and the least recently used entries until the cache is within its
+// limits. The cache lock must be held by the caller.
+func evictCacheEntries() {
+	for element := cache.lru.Front(); element != nil; {
+		next := element.Next()
+		if entry := element.Value.(*cacheEntry); entry.isRemovable() {
+			removeCacheEntry(element, "expired")
+		}
+		element = next
+	}
+
+	for (cache.maxEntries > 0 && cache.lru.Len() > cache.maxEntries) || (cache.maxBytes > 0 && cache.bytes > cache.maxBytes) {
+		removeCacheEntry(cache.lru.Back(), "size")
+	}
+}
+
+// removeCacheEntry removes the provided element from the cache. If a reason is
+// provided, the removal is counted as eviction and the entry is also deleted
+// from the store. Without a reason the entry is replaced by a new entry with
+// the same key. The cache lock must be held by the caller.
+func removeCacheEntry(element *list.Element, reason string) {
+	entry := cache.lru.Remove(element).(*cacheEntry)
+	delete(cache.entries, entry.key)
+	cache.bytes -= entry.size
+
+	metricCacheEntries.WithLabelValues(entry.scriptName).Dec()
+	metricCacheBytes.WithLabelValues(entry.scriptName).Sub(float64(entry.size))
+	if reason != "" {
+		metricCacheEvictionsTotal.WithLabelValues(entry.scriptName, reason).Inc()
+		deleteCacheEntry(entry)
 	}
 }
@@ -0,0 +1,107 @@
+package prober
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ricoberger/script_exporter/config"
+)
+
+// CacheEntry is the representation of an entry in the cache, which is returned
+// by the "/-/cache" endpoint.
+type CacheEntry struct {
+	Key        string    `json:"key"`
+	Script     string    `json:"script"`
+	CacheTime  time.Time `json:"cacheTime"`
+	ExpireTime time.Time `json:"expireTime"`
+	Age        float64   `json:"age"`
+	Expired    bool      `json:"expired"`
+	Size       int64     `json:"size"`
+	Success    bool      `json:"success"`
+	ExitCode   int       `json:"exitCode"`
+}
+
+// CacheHandler returns all entries of the cache as JSON, with the most recently
+// used entry first. The entries can be filtered by a script via the "script"
+// parameter.
+func CacheHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "This endpoint requires a GET request.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scriptName := r.URL.Query().Get("script")
+
+	cacheLock.Lock()
+	entries := []CacheEntry{}
+	for element := cache.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		if scriptName != "" && scriptName != entry.scriptName {
+			continue
+		}
+
+		entries = append(entries, CacheEntry{
+			Key:        entry.key,
+			Script:     entry.scriptName,
+			CacheTime:  entry.cacheTime,
+			ExpireTime: entry.expireTime,
+			Age:        time.Since(entry.cacheTime).Seconds(),
+			Expired:    entry.isExpired(),
+			Size:       entry.size,
+			Success:    entry.result.success == 1,
+			ExitCode:   entry.result.exitCode,
+		})
+	}
+	cacheLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		logger.Error("Error encoding cache entries", slog.Any("error", err))
+	}
+}
+
+// CacheInvalidateHandler removes entries from the cache. Without any parameter
+// all entries are removed. If only the "script" parameter is set, all entries
+// of this script are removed. If further parameters are set, only the entry for
+// a probe of the script with exactly these parameters is removed.
+func CacheInvalidateHandler(w http.ResponseWriter, r *http.Request, c *config.Config, logger *slog.Logger, scriptNoArgs bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "This endpoint requires a POST request.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	scriptName := params.Get("script")
+
+	var key string
+	if len(params) > 1 {
+		script := c.GetScript(scriptName)
+		if script == nil {
+			http.Error(w, "Script not found", http.StatusBadRequest)
+			return
+		}
+		key = getCacheKey(script, getScriptParamValues(params, scriptNoArgs), params)
+	} else if len(params) == 1 && scriptName == "" {
+		http.Error(w, "'script' parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	cacheLock.Lock()
+	invalidated := 0
+	for element := cache.lru.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*cacheEntry)
+		if (scriptName == "" || scriptName == entry.scriptName) && (key == "" || key == entry.key) {
+			removeCacheEntry(element, "invalidated")
+			invalidated++
+		}
+		element = next
+	}
+	cacheLock.Unlock()
+
+	logger.Info("Invalidated cache entries", slog.String("script", scriptName), slog.Int("entries", invalidated))
+	fmt.Fprintf(w, "Invalidated %d cache entries.\n", invalidated)
+}
@@ -0,0 +1,371 @@
+package prober
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// cacheStore is used to persist the entries of the cache, so that the cache
+// can be restored after a restart of the exporter. The entries are still served
+// from memory, the store is only written when an entry is added or removed and
+// read when the exporter is started.
+type cacheStore interface {
+	Load() ([]*cacheEntry, error)
+	Save(entry *cacheEntry) error
+	Delete(key string) error
+}
+
+var store cacheStore
+var storeLogger *slog.Logger
+
+// storedCacheEntry is the representation of a cache entry in a store. The
+// metric families are encoded via protobuf, so that they can be restored
+// without any loss.
+type storedCacheEntry struct {
+	Key              string         `json:"key"`
+	ScriptName       string         `json:"scriptName"`
+	CacheTime        time.Time      `json:"cacheTime"`
+	ExpireTime       time.Time      `json:"expireTime"`
+	StaleTime        time.Time      `json:"staleTime"`
+	KeepExpired      bool           `json:"keepExpired"`
+	StartTime        time.Time      `json:"startTime"`
+	Duration         float64        `json:"duration"`
+	Success          int            `json:"success"`
+	ExitCode         int            `json:"exitCode"`
+	ProcessUsage     *processUsage  `json:"processUsage,omitempty"`
+	ResourceUsage    *resourceUsage `json:"resourceUsage,omitempty"`
+	Args             []string       `json:"args"`
+	EnvKeys          []string       `json:"envKeys"`
+	Stdout           string         `json:"stdout"`
+	Stderr           string         `json:"stderr"`
+	Error            string         `json:"error"`
+	Metrics          [][]byte       `json:"metrics"`
+	ValidationErrors []string       `json:"validationErrors"`
+}
+
+func newStoredCacheEntry(entry *cacheEntry) (*storedCacheEntry, error) {
+	metrics := make([][]byte, 0, len(entry.result.metrics))
+	for _, metricFamily := range entry.result.metrics {
+		data, err := proto.Marshal(metricFamily)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, data)
+	}
+
+	return &storedCacheEntry{
+		Key:              entry.key,
+		ScriptName:       entry.scriptName,
+		CacheTime:        entry.cacheTime,
+		ExpireTime:       entry.expireTime,
+		StaleTime:        entry.staleTime,
+		KeepExpired:      entry.keepExpired,
+		StartTime:        entry.result.startTime,
+		Duration:         entry.result.duration,
+		Success:          entry.result.success,
+		ExitCode:         entry.result.exitCode,
+		ProcessUsage:     entry.result.processUsage,
+		ResourceUsage:    entry.result.resourceUsage,
+		Args:             entry.result.args,
+		EnvKeys:          entry.result.envKeys,
+		Stdout:           entry.result.stdout,
+		Stderr:           entry.result.stderr,
+		Error:            entry.result.err,
+		Metrics:          metrics,
+		ValidationErrors: entry.result.validationErrors,
+	}, nil
+}
+
+func (e *storedCacheEntry) cacheEntry() (*cacheEntry, error) {
+	metricFamilies := make([]*dto.MetricFamily, 0, len(e.Metrics))
+	for _, data := range e.Metrics {
+		metricFamily := &dto.MetricFamily{}
+		if err := proto.Unmarshal(data, metricFamily); err != nil {
+			return nil, err
+		}
+		metricFamilies = append(metricFamilies, metricFamily)
+	}
+
+	result := scriptResult{
+		startTime:        e.StartTime,
+		duration:         e.Duration,
+		runTime:          e.StartTime,
+		runDuration:      e.Duration,
+		success:          e.Success,
+		exitCode:         e.ExitCode,
+		processUsage:     e.ProcessUsage,
+		resourceUsage:    e.ResourceUsage,
+		args:             e.Args,
+		envKeys:          e.EnvKeys,
+		stdout:           e.Stdout,
+		stderr:           e.Stderr,
+		err:              e.Error,
+		metrics:          metricFamilies,
+		validationErrors: e.ValidationErrors,
+	}
+
+	return &cacheEntry{
+		key:         e.Key,
+		scriptName:  e.ScriptName,
+		cacheTime:   e.CacheTime,
+		expireTime:  e.ExpireTime,
+		staleTime:   e.StaleTime,
+		keepExpired: e.KeepExpired,
+		size:        getCacheResultSize(result),
+		result:      result,
+	}, nil
+}
+
+// fileCacheStore is a cacheStore, which saves each entry of the cache as JSON
+// file in a directory. The name of a file is the SHA-256 hash of the cache key.
+type fileCacheStore struct {
+	dir    string
+	logger *slog.Logger
+}
+
+func newFileCacheStore(dir string, logger *slog.Logger) (*fileCacheStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &fileCacheStore{dir: dir, logger: logger}, nil
+}
+
+func (s *fileCacheStore) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:])+".json")
+}
+
+// Load returns all entries from the directory. Files which can not be read are
+// removed, so that they do not fill up the directory.
+func (s *fileCacheStore) Load() ([]*cacheEntry, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*cacheEntry
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(s.dir, file.Name())
+
+		entry, err := s.load(path)
+		if err != nil {
+			s.logger.Warn("Removing invalid cache file", slog.String("file", path), slog.Any("error", err))
+			//nolint:errcheck
+			os.Remove(path)
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (s *fileCacheStore) load(path string) (*cacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var storedEntry storedCacheEntry
+	if err := json.Unmarshal(data, &storedEntry); err != nil {
+		return nil, err
+	}
+
+	if s.path(storedEntry.Key) != path {
+		return nil, fmt.Errorf("file name doesn't match cache key")
+	}
+
+	return storedEntry.cacheEntry()
+}
+
+// Save writes the entry to a temporary file, which is renamed afterwards, so
+// that a crash of the exporter doesn't leave a partially written file.
+func (s *fileCacheStore) Save(entry *cacheEntry) error {
+	storedEntry, err := newStoredCacheEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(storedEntry)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), s.path(entry.key))
+}
+
+func (s *fileCacheStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// SetCacheDir enables the persistence of the cache in the provided directory.
+// The entries which are already saved in the directory are loaded into the
+// cache with their original timestamps.
+func SetCacheDir(dir string, logger *slog.Logger) error {
+	fileStore, err := newFileCacheStore(dir, logger)
+	if err != nil {
+		return err
+	}
+
+	entries, err := fileStore.Load()
+	if err != nil {
+		return err
+	}
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	store = fileStore
+	storeLogger = logger
+
+	// The entries are added from the oldest to the newest entry, so that the
+	// oldest entries are evicted first, when the cache limits are reached.
+	slices.SortFunc(entries, func(a, b *cacheEntry) int {
+		return a.cacheTime.Compare(b.cacheTime)
+	})
+
+	for _, entry := range entries {
+		if existingElement, ok := cache.entries[entry.key]; ok {
+			removeCacheEntry(existingElement, "")
+		}
+		addCacheEntry(entry)
+	}
+	evictCacheEntries()
+
+	logger.Info("Loaded cache entries", slog.String("dir", dir), slog.Int("entries", cache.lru.Len()))
+	return nil
+}
+
+// storeWrite is a pending write to the store. If entry is nil, the key is
+// deleted from the store.
+type storeWrite struct {
+	store      cacheStore
+	logger     *slog.Logger
+	scriptName string
+	entry      *cacheEntry
+}
+
+// storeWrites contains the pending writes to the store, which are applied by a
+// single goroutine, so that the cache lock is not held while the store is
+// written. Only the last write for a key is kept, because it overrides all
+// previous writes for this key.
+var storeWrites = struct {
+	sync.Mutex
+	pending map[string]storeWrite
+	notify  chan struct{}
+	wg      sync.WaitGroup
+}{
+	pending: make(map[string]storeWrite),
+	notify:  make(chan struct{}, 1),
+}
+var storeWriterOnce sync.Once
+
+// saveCacheEntry saves a copy of the provided entry in the store, when the
+// persistence of the cache is enabled. The cache lock must be held by the
+// caller.
+func saveCacheEntry(entry *cacheEntry) {
+	if store == nil {
+		return
+	}
+
+	savedEntry := *entry
+	queueStoreWrite(entry.key, storeWrite{store: store, logger: storeLogger, scriptName: entry.scriptName, entry: &savedEntry})
+}
+
+// deleteCacheEntry deletes the entry with the provided key from the store, when
+// the persistence of the cache is enabled. The cache lock must be held by the
+// caller.
+func deleteCacheEntry(entry *cacheEntry) {
+	if store == nil {
+		return
+	}
+
+	queueStoreWrite(entry.key, storeWrite{store: store, logger: storeLogger, scriptName: entry.scriptName})
+}
+
+func queueStoreWrite(key string, write storeWrite) {
+	storeWriterOnce.Do(func() {
+		go writeStore()
+	})
+
+	storeWrites.Lock()
+	if _, ok := storeWrites.pending[key]; !ok {
+		storeWrites.wg.Add(1)
+	}
+	storeWrites.pending[key] = write
+	storeWrites.Unlock()
+
+	select {
+	case storeWrites.notify <- struct{}{}:
+	default:
+	}
+}
+
+// writeStore applies the pending writes to the store, each time it is notified
+// about new writes.
+func writeStore() {
+	for range storeWrites.notify {
+		storeWrites.Lock()
+		pending := storeWrites.pending
+		storeWrites.pending = make(map[string]storeWrite)
+		storeWrites.Unlock()
+
+		for key, write := range pending {
+			if write.entry != nil {
+				if err := write.store.Save(write.entry); err != nil {
+					write.logger.Error("Error saving cache entry", slog.String("script", write.scriptName), slog.Any("error", err))
+				}
+			} else {
+				if err := write.store.Delete(key); err != nil {
+					write.logger.Error("Error deleting cache entry", slog.String("script", write.scriptName), slog.Any("error", err))
+				}
+			}
+			storeWrites.wg.Done()
+		}
+	}
+}
+
+// FlushCache waits until all pending writes to the store are applied. It should
+// be called before the exporter is stopped, so that no changes of the cache are
+// lost.
+func FlushCache() {
+	storeWrites.wg.Wait()
+}
@@ -0,0 +1,114 @@
+package prober
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// newScriptDesc returns the descriptor for one of the default metrics of a
+// script. The configured labels of the script are added as constant labels.
+func newScriptDesc(name, help string, labels map[string]string) *prometheus.Desc {
+	return prometheus.NewDesc(name, help, []string{"script"}, labels)
+}
+
+// scriptCollector is a prometheus.Collector, which returns the metrics for the
+// result of a single script execution. A new collector is created for every
+// script within a probe and registered in the registry of the probe.
+type scriptCollector struct {
+	script               *config.Script
+	result               scriptResult
+	labels               map[string]string
+	outputMetricFamilies []*dto.MetricFamily
+}
+
+// Describe implements the prometheus.Collector interface. It doesn't send any
+// descriptors, because the metrics returned by the output of a script are not
+// known in advance. This makes the collector an unchecked collector, so that
+// the collectors for multiple scripts can be registered in the same registry.
+func (c *scriptCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements the prometheus.Collector interface.
+func (c *scriptCollector) Collect(ch chan<- prometheus.Metric) {
+	generateScriptMetrics(ch, c.script, c.result, c.labels, c.outputMetricFamilies)
+}
+
+// getOutputMetricFamilies returns the metric families from the output of a
+// script. The provided labels are added to all metrics, before the metric
+// relabel configurations of the script are applied.
+func getOutputMetricFamilies(script *config.Script, logger *slog.Logger, result scriptResult, labels map[string]string) []*dto.MetricFamily {
+	return relabelMetricFamilies(script, logger, addLabels(result.metrics, labels))
+}
+
+// normalizeHelp replaces the help text of the provided metric families with
+// the help text, which was seen first for a metric family with the same name.
+// The provided map contains the seen help texts and is updated with the help
+// texts of new metric families. The metric families are not modified, because
+// they might also be referenced by the cache.
+func normalizeHelp(metricFamilies []*dto.MetricFamily, helps map[string]string) []*dto.MetricFamily {
+	normalizedMetricFamilies := make([]*dto.MetricFamily, 0, len(metricFamilies))
+
+	for _, metricFamily := range metricFamilies {
+		help, ok := helps[metricFamily.GetName()]
+		if !ok {
+			helps[metricFamily.GetName()] = metricFamily.GetHelp()
+			normalizedMetricFamilies = append(normalizedMetricFamilies, metricFamily)
+			continue
+		}
+
+		if help != metricFamily.GetHelp() {
+			metricFamily = &dto.MetricFamily{
+				Name:   metricFamily.Name,
+				Help:   proto.String(help),
+				Type:   metricFamily.Type,
+				Unit:   metricFamily.Unit,
+				Metric: metricFamily.Metric,
+			}
+		}
+		normalizedMetricFamilies = append(normalizedMetricFamilies, metricFamily)
+	}
+
+	return normalizedMetricFamilies
+}
+
+// outputMetric is a prometheus.Metric, which wraps a metric from the output of
+// a script, so that it can be returned by a collector.
+type outputMetric struct {
+	desc   *prometheus.Desc
+	metric *dto.Metric
+}
+
+func newOutputMetrics(metricFamily *dto.MetricFamily) []prometheus.Metric {
+	desc := prometheus.NewDesc(metricFamily.GetName(), metricFamily.GetHelp(), nil, nil)
+
+	metrics := make([]prometheus.Metric, 0, len(metricFamily.GetMetric()))
+	for _, metric := range metricFamily.GetMetric() {
+		metrics = append(metrics, &outputMetric{desc: desc, metric: metric})
+	}
+
+	return metrics
+}
+
+// Desc implements the prometheus.Metric interface.
+func (m *outputMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+// Write implements the prometheus.Metric interface. The wrapped metric is
+// copied, because the metric is also referenced by the cache. The labels of
+// the metric are sorted by their name, which is required by the registry.
+func (m *outputMetric) Write(out *dto.Metric) error {
+	proto.Merge(out, m.metric)
+
+	slices.SortFunc(out.Label, func(a, b *dto.LabelPair) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+
+	return nil
+}
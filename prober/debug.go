@@ -0,0 +1,61 @@
+package prober
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// writeDebugOutput writes the debug output for a probe, which was requested
+// with the "debug=true" query parameter. For each script it contains the
+// details of the execution, like the command line, the names of the
+// environment variables, the exit code, the duration, stdout, stderr and the
+// errors which occurred while the output was validated. The metrics, which
+// would have been returned by the probe, are written at the end.
+func writeDebugOutput(w http.ResponseWriter, logger *slog.Logger, scripts []*config.Script, results []scriptResult, registry *prometheus.Registry) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	var output strings.Builder
+
+	for i, script := range scripts {
+		result := results[i]
+
+		fmt.Fprintf(&output, "Script: %s\n", script.Name)
+		fmt.Fprintf(&output, "Command: %s\n", strings.Join(result.args, " "))
+		fmt.Fprintf(&output, "Environment: %s\n", strings.Join(result.envKeys, ", "))
+		fmt.Fprintf(&output, "Exit Code: %d\n", result.exitCode)
+		fmt.Fprintf(&output, "Duration: %fs\n", result.duration)
+		fmt.Fprintf(&output, "Cached: %t\n", result.cached == 1)
+		if result.err != "" {
+			fmt.Fprintf(&output, "Error: %s\n", result.err)
+		}
+
+		fmt.Fprintf(&output, "\nStdout:\n%s\n", result.stdout)
+		fmt.Fprintf(&output, "\nStderr:\n%s\n", result.stderr)
+		fmt.Fprintf(&output, "\nValidation Errors:\n%s\n\n", strings.Join(result.validationErrors, "\n"))
+	}
+
+	output.WriteString("Metrics that would have been returned:\n")
+
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		logger.Error("Error gathering metrics", slog.Any("error", err))
+		fmt.Fprintf(&output, "Error gathering metrics: %s\n", err)
+	}
+
+	encoder := expfmt.NewEncoder(&output, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, metricFamily := range metricFamilies {
+		if err := encoder.Encode(metricFamily); err != nil {
+			logger.Error("Error encoding metric family", slog.String("metricFamily", metricFamily.GetName()), slog.Any("error", err))
+		}
+	}
+
+	//nolint:gosec
+	w.Write([]byte(output.String()))
+}
@@ -1,17 +1,21 @@
 package prober
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ricoberger/script_exporter/config"
@@ -20,16 +24,82 @@ import (
 	prometheusserializer "github.com/influxdata/telegraf/plugins/serializers/prometheus"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/protobuf/proto"
 )
 
+var scriptExecutions singleflight.Group
+
+// executionCallers contains the contexts of deduplicated script executions,
+// which are cancelled when all callers of the execution have disconnected.
+var executionCallers = make(map[string]*executionCaller)
+var executionCallersLock = sync.Mutex{}
+
+type executionCaller struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	callers int
+}
+
+// joinExecution returns the context for the execution of the script with the
+// provided cache key. The returned context is cancelled, when the contexts of
+// all callers, which joined the execution, are done. The returned function
+// must be called, when the caller received the result of the execution.
+func joinExecution(ctx context.Context, key string) (context.Context, func()) {
+	executionCallersLock.Lock()
+	defer executionCallersLock.Unlock()
+
+	caller, ok := executionCallers[key]
+	if !ok {
+		executionCtx, cancel := context.WithCancel(context.Background())
+		caller = &executionCaller{ctx: executionCtx, cancel: cancel}
+		executionCallers[key] = caller
+	}
+	caller.callers++
+
+	leave := func() {
+		executionCallersLock.Lock()
+		defer executionCallersLock.Unlock()
+
+		caller.callers--
+		if caller.callers == 0 {
+			caller.cancel()
+			if executionCallers[key] == caller {
+				delete(executionCallers, key)
+			}
+		}
+	}
+
+	stop := context.AfterFunc(ctx, leave)
+	return caller.ctx, func() {
+		if stop() {
+			leave()
+		}
+	}
+}
+
 type scriptResult struct {
-	startTime time.Time
-	success   int
-	exitCode  int
-	cached    int
-	output    string
+	startTime        time.Time
+	duration         float64
+	runTime          time.Time
+	runDuration      float64
+	success          int
+	exitCode         int
+	cached           int
+	rejected         bool
+	processUsage     *processUsage
+	resourceUsage    *resourceUsage
+	args             []string
+	envKeys          []string
+	stdout           string
+	stderr           string
+	err              string
+	metrics          []*dto.MetricFamily
+	validationErrors []string
 }
 
 var (
@@ -48,6 +118,46 @@ var (
 		Name:      "http_requests_total",
 		Help:      "Number of HTTP requests processed, partitioned by script.",
 	}, []string{"script"})
+	metricOutputDroppedLinesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "output_dropped_lines_total",
+		Help:      "Number of lines from the output of scripts, which were dropped because they are invalid, partitioned by script.",
+	}, []string{"script"})
+	metricDeduplicatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "deduplicated_requests_total",
+		Help:      "Number of requests which were served by the concurrent execution of the same script with the same parameters, partitioned by script.",
+	}, []string{"script"})
+	metricCancelledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "cancelled_total",
+		Help:      "Number of script executions which were cancelled, because the scraper has disconnected, partitioned by script.",
+	}, []string{"script"})
+	metricCPUUserSecondsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "cpu_user_seconds_total",
+		Help:      "Total CPU time spent by scripts in user mode in seconds, partitioned by script.",
+	}, []string{"script"})
+	metricCPUSystemSecondsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "cpu_system_seconds_total",
+		Help:      "Total CPU time spent by scripts in kernel mode in seconds, partitioned by script.",
+	}, []string{"script"})
+	metricVoluntaryContextSwitchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "voluntary_context_switches_total",
+		Help:      "Total number of voluntary context switches of scripts, partitioned by script.",
+	}, []string{"script"})
+	metricInvoluntaryContextSwitchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "involuntary_context_switches_total",
+		Help:      "Total number of involuntary context switches of scripts, partitioned by script.",
+	}, []string{"script"})
+	metricForceKilledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "force_killed_total",
+		Help:      "Number of scripts which were killed via SIGKILL, because they were still running after the grace period of the timeout, partitioned by script.",
+	}, []string{"script"})
 	metricReqDurationSeconds = promauto.NewSummaryVec(prometheus.SummaryOpts{
 		Namespace:  "script_exporter",
 		Name:       "http_request_duration_seconds",
@@ -56,13 +166,17 @@ var (
 	}, []string{"script"})
 )
 
-func Handler(w http.ResponseWriter, r *http.Request, c *config.Config, logger *slog.Logger, logEnv bool, scriptTimeoutOffset float64, scriptNoArgs bool) {
-	w.Header().Set("Content-Type", "text/plain")
-
+func Handler(w http.ResponseWriter, r *http.Request, c *config.Config, logger *slog.Logger, logEnv bool, scriptTimeoutOffset float64, scriptNoArgs bool, scriptMaxParallel int) {
 	prometheusTimeout := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
 	params := r.URL.Query()
 	scriptNames := params["script"]
 
+	// The "debug" parameter is only used by the exporter and removed from the
+	// parameters, so that it is not passed to the scripts and a probe with
+	// debug output runs the scripts in the same way as a normal probe.
+	debug := params.Get("debug") == "true"
+	params.Del("debug")
+
 	if len(scriptNames) == 0 {
 		logger.Error("'script' parameter is missing")
 		metricScriptUnknownTotal.Inc()
@@ -70,33 +184,102 @@ func Handler(w http.ResponseWriter, r *http.Request, c *config.Config, logger *s
 		return
 	}
 
+	// Lookup all requested scripts before one of them is run, so that we do
+	// not return a partial response when one of the scripts does not exist.
+	scripts := make([]*config.Script, 0, len(scriptNames))
 	for _, scriptName := range scriptNames {
 		script := c.GetScript(scriptName)
 		if script == nil {
-			logger.Error("Script not found", "script", r.URL.Query().Get("script"))
+			logger.Error("Script not found", "script", scriptName)
 			metricScriptUnknownTotal.Inc()
 			http.Error(w, "Script not found", http.StatusBadRequest)
 			return
 		}
 
-		metricReqInflight.WithLabelValues(scriptName).Inc()
-		defer metricReqInflight.WithLabelValues(scriptName).Dec()
+		scripts = append(scripts, script)
+	}
+
+	// Run all requested scripts concurrently. The number of scripts which are
+	// run at the same time can be limited via the "scriptMaxParallel" argument.
+	var parallel chan struct{}
+	if scriptMaxParallel > 0 {
+		parallel = make(chan struct{}, scriptMaxParallel)
+	}
+
+	results := make([]scriptResult, len(scripts))
+
+	var wg sync.WaitGroup
+	for i, script := range scripts {
+		wg.Go(func() {
+			if parallel != nil {
+				parallel <- struct{}{}
+				defer func() { <-parallel }()
+			}
+
+			metricReqInflight.WithLabelValues(script.Name).Inc()
+			defer metricReqInflight.WithLabelValues(script.Name).Dec()
+
+			start := time.Now()
+
+			// If the script is scheduled with the requested parameters, the
+			// result of the last scheduled run is returned. Otherwise, e.g. when
+			// the scheduled script was not run yet, the script is run for the
+			// probe.
+			if scheduledResult := getScheduleResult(script, params); scheduledResult != nil {
+				logger.Debug("Using scheduled script result", slog.String("script", script.Name))
+				results[i] = *scheduledResult
+			} else {
+				results[i] = handleScript(r.Context(), script, params, logger, logEnv, prometheusTimeout, scriptTimeoutOffset, scriptNoArgs)
+				addHistoryEntry(script, params, results[i])
+			}
 
-		start := time.Now()
+			logger.Debug("Script was run", slog.String("script", script.Name), slog.Duration("duration", time.Since(start)))
+			metricReqCount.WithLabelValues(script.Name).Inc()
+			metricReqDurationSeconds.WithLabelValues(script.Name).Observe(time.Since(start).Seconds())
+		})
+	}
+	wg.Wait()
+
+	// The metrics for all scripts are collected into a registry, which is only
+	// used for this probe. The registry merges the metric families of all
+	// scripts and promhttp takes care of the content negotiation with the
+	// scraper. Since the registry rejects metric families with the same name,
+	// but a different help text, the help text of the metric family which was
+	// seen first is used for all scripts.
+	registry := prometheus.NewRegistry()
+	helps := make(map[string]string)
+	for i, script := range scripts {
+		labels := renderLabels(script, logger, params)
+		outputMetricFamilies := normalizeHelp(getOutputMetricFamilies(script, logger, results[i], labels), helps)
+		registry.MustRegister(&scriptCollector{script: script, result: results[i], labels: labels, outputMetricFamilies: outputMetricFamilies})
+	}
 
-		output := handleScript(script, params, logger, logEnv, prometheusTimeout, scriptTimeoutOffset, scriptNoArgs)
+	if debug {
+		writeDebugOutput(w, logger, scripts, results, registry)
+		return
+	}
 
-		logger.Debug("Script was run", slog.Duration("duration", time.Since(start)), slog.String("output", output))
-		metricReqCount.WithLabelValues(scriptName).Inc()
-		metricReqDurationSeconds.WithLabelValues(scriptName).Observe(time.Since(start).Seconds())
-		//nolint:gosec
-		fmt.Fprint(w, output)
+	// If one of the scripts was rejected, because no execution slot was free,
+	// the probe fails, so that the scraper can retry it later.
+	for i, script := range scripts {
+		if results[i].rejected {
+			http.Error(w, fmt.Sprintf("Script %s was rejected: %s", script.Name, results[i].err), http.StatusServiceUnavailable)
+			return
+		}
 	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ErrorHandling:     promhttp.ContinueOnError,
+		EnableOpenMetrics: true,
+	}).ServeHTTP(w, r)
 }
 
-func handleScript(script *config.Script, params url.Values, logger *slog.Logger, logEnv bool, prometheusTimeout string, scriptTimeoutOffset float64, scriptNoArgs bool) string {
-	// Get parameters, if the scriptNoArgs flag is set to true, we do not add
-	// arguments from the params query parameter to the script.
+// getScriptParamValues returns the values of the parameters, which are listed
+// in the "params" parameter and passed as arguments to the script. If the
+// scriptNoArgs flag is set to true, we do not add arguments from the params
+// query parameter to the script.
+func getScriptParamValues(params url.Values, scriptNoArgs bool) []string {
 	var scriptParamValues []string
 	if !scriptNoArgs {
 		scriptParams := params.Get("params")
@@ -109,29 +292,116 @@ func handleScript(script *config.Script, params url.Values, logger *slog.Logger,
 		}
 	}
 
+	return scriptParamValues
+}
+
+func handleScript(ctx context.Context, script *config.Script, params url.Values, logger *slog.Logger, logEnv bool, prometheusTimeout string, scriptTimeoutOffset float64, scriptNoArgs bool) scriptResult {
+	scriptParamValues := getScriptParamValues(params, scriptNoArgs)
+
 	result := scriptResult{
 		startTime: time.Now(),
+		duration:  0,
 		success:   1,
 		exitCode:  -1,
 		cached:    0,
-		output:    "",
 	}
 
+	cacheKey := getCacheKey(script, scriptParamValues, params)
+
 	// Check if the result of the script is cached and not stale. If this is the
 	// case the getCacheResult function will return a scriptResult which we can
-	// directly return.
-	if cachedResult := getCacheResult(script, scriptParamValues, false); cachedResult != nil {
+	// directly return. If the result is expired, but within the
+	// "stale_while_revalidate" window, the result is also returned and the
+	// script is run in the background to refresh the cached result. The
+	// background run is deduplicated with other runs of the script, so that
+	// only one refresh is running at the same time.
+	if cachedResult, revalidate := getCacheResult(script, cacheKey, false); cachedResult != nil {
 		cachedResult.startTime = result.startTime
+		cachedResult.duration = time.Since(result.startTime).Seconds()
 		cachedResult.cached = 1
 
+		if revalidate {
+			logger.Debug("Refreshing stale script result in the background", "script", script.Name)
+			metricCacheRevalidationsTotal.WithLabelValues(script.Name).Inc()
+
+			go scriptExecutions.Do(cacheKey, func() (any, error) {
+				refreshedResult := executeScript(context.Background(), script, params, logger, logEnv, prometheusTimeout, scriptTimeoutOffset, scriptParamValues, cacheKey, result)
+				addHistoryEntry(script, params, refreshedResult)
+				return refreshedResult, nil
+			})
+		}
+
 		logger.Debug("Using cached script result", "script", script.Name)
-		return generateScriptMetrics(script, *cachedResult)
+		return *cachedResult
+	}
+
+	// Concurrent executions of a script with the same parameters are
+	// deduplicated, e.g. when multiple Prometheus replicas are scraping the
+	// same target at the same time. Only the first caller runs the script, all
+	// other callers are waiting for the run and are sharing its result. The
+	// shared execution doesn't use the context of a single caller, so that the
+	// wait for an execution slot is only aborted and the script is only
+	// cancelled (when the "cancel_on_disconnect" option is set), when all
+	// callers have disconnected.
+	ctx, leave := joinExecution(ctx, cacheKey)
+	defer leave()
+
+	leader := false
+	sharedResult, _, _ := scriptExecutions.Do(cacheKey, func() (any, error) {
+		leader = true
+		return executeScript(ctx, script, params, logger, logEnv, prometheusTimeout, scriptTimeoutOffset, scriptParamValues, cacheKey, result), nil
+	})
+
+	if !leader {
+		logger.Debug("Using result of concurrent script execution", "script", script.Name)
+		metricDeduplicatedTotal.WithLabelValues(script.Name).Inc()
 	}
 
+	return sharedResult.(scriptResult)
+}
+
+// executeScript runs the script and returns its result. The result is also
+// added to the cache, when caching is enabled for the script.
+func executeScript(ctx context.Context, script *config.Script, params url.Values, logger *slog.Logger, logEnv bool, prometheusTimeout string, scriptTimeoutOffset float64, scriptParamValues []string, cacheKey string, result scriptResult) scriptResult {
 	// Get the timeout from either Prometheus's HTTP header or a URL query
 	// parameter, clamped to a maximum specified through the configuration file.
 	timeout := getTimeout(params, prometheusTimeout, scriptTimeoutOffset, script.Timeout.MaxTimeout)
 
+	// Wait for a free execution slot, when the number of concurrent executions
+	// is limited for the script or globally. Waiting for a slot longer than the
+	// timeout is not useful, because the scraper has already given up. If no
+	// slot can be acquired, the expired cache is returned when configured,
+	// otherwise the execution is rejected.
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, time.Duration(timeout*float64(time.Second)))
+		defer cancel()
+	}
+
+	release, err := acquireExecutionSlot(waitCtx, script)
+	if err != nil {
+		metricQueueRejectedTotal.WithLabelValues(script.Name).Inc()
+
+		if script.Queue.OnFull == "stale" {
+			if cachedResult, _ := getCacheResult(script, cacheKey, true); cachedResult != nil {
+				cachedResult.startTime = result.startTime
+				cachedResult.duration = time.Since(result.startTime).Seconds()
+				cachedResult.cached = 1
+
+				logger.Debug("Using stale cached script result, because no execution slot is free", "script", script.Name)
+				return *cachedResult
+			}
+		}
+
+		logger.Error("Script execution rejected", slog.String("script", script.Name), slog.Any("error", err))
+		result.success = 0
+		result.rejected = true
+		result.err = err.Error()
+		return result
+	}
+	defer release()
+
 	// Append arguments passed via scrape query parameters to the arguments
 	// defined in the script configuration.
 	runArgs := []string{}
@@ -156,54 +426,107 @@ func handleScript(script *config.Script, params url.Values, logger *slog.Logger,
 		}
 	}
 
-	output, exitCode, err := runScript(script, logger, logEnv, timeout, runArgs, runEnv)
+	// Remember the arguments and the names of the environment variables, which
+	// are passed to the script, so that they can be shown in the debug output
+	// of a probe. The values of the environment variables are not stored, since
+	// they might contain secrets.
+	result.args = runArgs
+	result.envKeys = slices.Sorted(maps.Keys(runEnv))
+	if timeout > 0 {
+		result.envKeys = append(result.envKeys, "SCRIPT_TIMEOUT", "SCRIPT_DEADLINE", "SCRIPT_TIMEOUT_ENFORCED")
+	}
+
+	output, stderr, exitCode, usage, err := runScript(ctx, script, logger, logEnv, timeout, runArgs, runEnv)
+	result.duration = time.Since(result.startTime).Seconds()
+	result.runTime = result.startTime
+	result.runDuration = result.duration
 	result.exitCode = exitCode
-	result.output = getFormattedOutput(script, logger, output, err)
+	result.processUsage = usage.process
+	result.resourceUsage = usage.resources
+	result.stdout = output
+	result.stderr = stderr
+	if err != nil {
+		result.err = err.Error()
+	}
+	result.metrics, result.validationErrors = getFormattedOutput(script, logger, output, err)
+
+	if usage.process != nil {
+		metricCPUUserSecondsTotal.WithLabelValues(script.Name).Add(usage.process.CPUUserSeconds)
+		metricCPUSystemSecondsTotal.WithLabelValues(script.Name).Add(usage.process.CPUSystemSeconds)
+		metricVoluntaryContextSwitchesTotal.WithLabelValues(script.Name).Add(usage.process.VoluntaryContextSwitches)
+		metricInvoluntaryContextSwitchesTotal.WithLabelValues(script.Name).Add(usage.process.InvoluntaryContextSwitches)
+	}
+
+	// The result of a script, which was cancelled because the scraper has
+	// disconnected, is not cached, since it is not the result of a complete
+	// run.
+	if script.Timeout.CancelOnDisconnect && ctx.Err() != nil {
+		logger.Debug("Script execution cancelled, because the scraper has disconnected", "script", script.Name)
+		metricCancelledTotal.WithLabelValues(script.Name).Inc()
+		result.success = 0
+		return result
+	}
 
 	if err != nil {
 		result.success = 0
 
 		if script.Cache.UseExpiredCacheOnError {
-			if cachedResult := getCacheResult(script, scriptParamValues, true); cachedResult != nil {
+			if cachedResult, _ := getCacheResult(script, cacheKey, true); cachedResult != nil {
 				cachedResult.startTime = result.startTime
+				cachedResult.duration = time.Since(result.startTime).Seconds()
 				cachedResult.cached = 1
 
 				logger.Debug("Using cached script result", "script", script.Name)
-				return generateScriptMetrics(script, *cachedResult)
+				return *cachedResult
 			}
 		}
 
 		if script.Cache.CacheOnError {
-			setCacheResult(script, scriptParamValues, result)
+			setCacheResult(script, cacheKey, result)
 		}
 
-		return generateScriptMetrics(script, result)
+		return result
 	}
 
-	setCacheResult(script, scriptParamValues, result)
-	return generateScriptMetrics(script, result)
+	setCacheResult(script, cacheKey, result)
+	return result
 }
 
-func generateScriptMetrics(script *config.Script, result scriptResult) string {
-	return `
-# HELP script_success Script exit status (0 = error, 1 = success).
-# TYPE script_success gauge
-script_success{script="` + script.Name + `"} ` + fmt.Sprintf("%d", result.success) + `
-
-# HELP script_duration_seconds Script execution time, in seconds.
-# TYPE script_duration_seconds gauge
-script_duration_seconds{script="` + script.Name + `"} ` + fmt.Sprintf("%f", time.Since(result.startTime).Seconds()) + `
+// generateScriptMetrics sends the default metrics for a script result together
+// with the provided metric families from the output of the script to the
+// provided channel. The provided labels are added to the default metrics.
+func generateScriptMetrics(ch chan<- prometheus.Metric, script *config.Script, result scriptResult, labels map[string]string, outputMetricFamilies []*dto.MetricFamily) {
+	ch <- prometheus.MustNewConstMetric(newScriptDesc("script_success", "Script exit status (0 = error, 1 = success).", labels), prometheus.GaugeValue, float64(result.success), script.Name)
+	ch <- prometheus.MustNewConstMetric(newScriptDesc("script_duration_seconds", "Script execution time, in seconds.", labels), prometheus.GaugeValue, result.duration, script.Name)
+	ch <- prometheus.MustNewConstMetric(newScriptDesc("script_exit_code", "The exit code of the script.", labels), prometheus.GaugeValue, float64(result.exitCode), script.Name)
+	ch <- prometheus.MustNewConstMetric(newScriptDesc("script_cached", "Script result is returned from cache (0 = no, 1 = yes).", labels), prometheus.GaugeValue, float64(result.cached), script.Name)
+
+	// The age of the result and the time of the last run are only known, when
+	// the script was run. They are not known, when the execution was rejected.
+	if !result.runTime.IsZero() {
+		runEndTime := result.runTime.Add(time.Duration(result.runDuration * float64(time.Second)))
+		ch <- prometheus.MustNewConstMetric(newScriptDesc("script_cache_age_seconds", "Time since the run of the script, which produced the returned result, has finished, in seconds.", labels), prometheus.GaugeValue, max(time.Since(runEndTime).Seconds(), 0), script.Name)
+		ch <- prometheus.MustNewConstMetric(newScriptDesc("script_last_run_timestamp_seconds", "Timestamp of the start of the run of the script, which produced the returned result.", labels), prometheus.GaugeValue, float64(result.runTime.UnixNano())/1e9, script.Name)
+	}
 
-# HELP script_exit_code The exit code of the script.
-# TYPE script_exit_code gauge
-script_exit_code{script="` + script.Name + `"} ` + fmt.Sprintf("%d", result.exitCode) + `
+	if result.processUsage != nil {
+		ch <- prometheus.MustNewConstMetric(newScriptDesc("script_cpu_user_seconds", "CPU time spent by the script in user mode, in seconds.", labels), prometheus.GaugeValue, result.processUsage.CPUUserSeconds, script.Name)
+		ch <- prometheus.MustNewConstMetric(newScriptDesc("script_cpu_system_seconds", "CPU time spent by the script in kernel mode, in seconds.", labels), prometheus.GaugeValue, result.processUsage.CPUSystemSeconds, script.Name)
+		ch <- prometheus.MustNewConstMetric(newScriptDesc("script_max_rss_bytes", "Maximum resident set size of the script, in bytes.", labels), prometheus.GaugeValue, result.processUsage.MaxRSSBytes, script.Name)
+		ch <- prometheus.MustNewConstMetric(newScriptDesc("script_voluntary_context_switches", "Number of voluntary context switches of the script.", labels), prometheus.GaugeValue, result.processUsage.VoluntaryContextSwitches, script.Name)
+		ch <- prometheus.MustNewConstMetric(newScriptDesc("script_involuntary_context_switches", "Number of involuntary context switches of the script.", labels), prometheus.GaugeValue, result.processUsage.InvoluntaryContextSwitches, script.Name)
+	}
 
-# HELP script_cached Script result is returned from cache (0 = no, 1 = yes).
-# TYPE script_cached gauge
-script_cached{script="` + script.Name + `"} ` + fmt.Sprintf("%d", result.cached) + `
+	if result.resourceUsage != nil {
+		ch <- prometheus.MustNewConstMetric(newScriptDesc("script_memory_peak_bytes", "Peak memory usage of the script, in bytes.", labels), prometheus.GaugeValue, result.resourceUsage.MemoryPeakBytes, script.Name)
+		ch <- prometheus.MustNewConstMetric(newScriptDesc("script_cpu_seconds", "CPU time used by the script, in seconds.", labels), prometheus.GaugeValue, result.resourceUsage.CPUSeconds, script.Name)
+	}
 
-` + result.output + `
-`
+	for _, metricFamily := range outputMetricFamilies {
+		for _, metric := range newOutputMetrics(metricFamily) {
+			ch <- metric
+		}
+	}
 }
 
 // getTimeout gets the Prometheus scrape timeout (in seconds) from the HTTP
@@ -236,14 +559,33 @@ func getTimeout(params url.Values, prometheusTimeout string, scriptTimeoutOffset
 	}
 }
 
-func runScript(script *config.Script, logger *slog.Logger, logEnv bool, timeout float64, args []string, env map[string]string) (string, int, error) {
-	// Tentatively, we do not inherit the context from the HTTP request. Doing
-	// so would provide automatic termination should the client close the
+// defaultGracePeriod is the time between terminating the process group of a
+// script via the kill signal and killing the remaining processes via SIGKILL,
+// when no grace period is configured for the script.
+const defaultGracePeriod = 5 * time.Second
+
+// getGracePeriod returns the configured grace period of the script or the
+// default grace period.
+func getGracePeriod(script *config.Script) time.Duration {
+	if script.Timeout.GracePeriod == nil {
+		return defaultGracePeriod
+	}
+
+	return time.Duration(*script.Timeout.GracePeriod * float64(time.Second))
+}
+
+func runScript(requestCtx context.Context, script *config.Script, logger *slog.Logger, logEnv bool, timeout float64, args []string, env map[string]string) (string, string, int, scriptUsage, error) {
+	// By default, we do not inherit the context from the HTTP request. Doing
+	// so provides automatic termination should the client close the
 	// connection, but it would mean that all scripts would be subject to abrupt
-	// termination regardless of any 'enforced' settings. Right now, abrupt
-	// termination requires opting in in the configuration file.
+	// termination regardless of any 'enforced' settings. Therefore the
+	// termination on a closed connection requires opting in via the
+	// "cancel_on_disconnect" option in the configuration file.
 	var cancel context.CancelFunc
 	ctx := context.Background()
+	if script.Timeout.CancelOnDisconnect {
+		ctx = requestCtx
+	}
 	deadline := time.Now().Add(time.Duration(timeout * float64(time.Second)))
 
 	if timeout > 0 && script.Timeout.Enforced {
@@ -255,16 +597,23 @@ func runScript(script *config.Script, logger *slog.Logger, logEnv bool, timeout
 	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 
 	// When the executed script spawns it's own child processes (e.g. "sleep")
-	// the child process will not be killed when the context deadline is
-	// exceeded. Because "cmd.Wait()" waits for the command to exit and for
-	// outputs being copied it will only return if the child process also
-	// finishes. To enforce the timeout we can set "cmd.WaitDelay" to a non-zero
-	// value to ensure that the executet script is killed even if the io pipes
-	// are not closed.
+	// only the script would be killed when the context deadline is exceeded.
+	// Because "cmd.Wait()" waits for the command to exit and for outputs being
+	// copied it would only return if the child process also finishes. To avoid
+	// this the script is started in its own process group and the whole group
+	// is terminated via the configured kill signal when the timeout is
+	// enforced. Processes which are still running after the grace period are
+	// killed via SIGKILL.
+	//
+	// Additionally "cmd.WaitDelay" can be set to a non-zero value to ensure
+	// that "cmd.Wait()" returns even if the io pipes are not closed, e.g.
+	// because a child process started its own process group.
 	//
 	// See:
 	//   - https://medium.com/@felixge/killing-a-child-process-and-all-of-its-children-in-go-54079af94773
 	//   - https://stackoverflow.com/q/71714228
+	stopProcessGroup := setProcessGroup(cmd, script.Name, script.Timeout.KillSignal, getGracePeriod(script))
+
 	if script.Timeout.WaitDelay > 0 {
 		cmd.WaitDelay = time.Duration(script.Timeout.WaitDelay * float64(time.Second))
 	}
@@ -304,76 +653,246 @@ func runScript(script *config.Script, logger *slog.Logger, logEnv bool, timeout
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	// If resource limits are configured for the script, the script is started
+	// in its own cgroup or the limits are approximated via setrlimit, before
+	// the script is executed. The maximum number of open files is always
+	// applied via setrlimit. The used resources are only reported for scripts
+	// with resource limits.
+	var resources *scriptResources
+	if script.Resources.IsSet() {
+		resources = newScriptResources(script, logger, timeout)
+		defer resources.close()
+		resources.prepare(cmd)
+	}
+
+	err := cmd.Start()
+	if err == nil {
+		if resources != nil {
+			resources.started(cmd.Process.Pid)
+		}
+		err = cmd.Wait()
+		stopProcessGroup()
+	}
+
+	usage := scriptUsage{process: getProcessUsage(cmd.ProcessState)}
+	if resources != nil {
+		usage.resources = resources.usage(cmd.ProcessState)
+
+		// On Linux the maximum resident set size of a script is at least the
+		// resident set size of the exporter, because it is inherited when the
+		// script is started. If the script was run in its own cgroup, the peak
+		// memory usage of the cgroup is used instead.
+		if memoryPeak, ok := resources.memoryPeak(); ok && usage.process != nil {
+			usage.process.MaxRSSBytes = memoryPeak
+		}
+	}
+
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			logger.Error("Script execution failed", slog.String("script", script.Name), slog.String("args", strings.Join(args, ",")), slog.String("env", logEnvValues), slog.String("stdout", stdout.String()), slog.String("stderr", stderr.String()), slog.Int("exitCode", exitError.ExitCode()), slog.Any("error", err))
-			return stdout.String(), exitError.ExitCode(), err
+			return stdout.String(), stderr.String(), exitError.ExitCode(), usage, err
 		}
 
 		logger.Error("Script execution failed", slog.String("script", script.Name), slog.String("args", strings.Join(args, ",")), slog.String("env", logEnvValues), slog.String("stdout", stdout.String()), slog.String("stderr", stderr.String()), slog.Int("exitCode", -1), slog.Any("error", err))
-		return stdout.String(), -1, err
+		return stdout.String(), stderr.String(), -1, usage, err
 	}
 
 	logger.Debug("Script execution succeeded", slog.String("script", script.Name), slog.String("args", strings.Join(args, ",")), slog.String("env", logEnvValues), slog.String("stdout", stdout.String()), slog.String("stderr", stderr.String()), slog.Int("exitCode", 0))
-	return stdout.String(), 0, nil
+	return stdout.String(), stderr.String(), 0, usage, nil
 }
 
-func getFormattedOutput(script *config.Script, logger *slog.Logger, output string, err error) string {
+// getFormattedOutput parses the output of a script into metric families,
+// according to the configured output format. Besides the metric families it
+// returns all errors which occurred while the output was validated.
+func getFormattedOutput(script *config.Script, logger *slog.Logger, output string, err error) ([]*dto.MetricFamily, []string) {
 	if script.Output.Ignore {
-		return ""
+		return nil, nil
 	}
 
 	if err != nil && script.Output.IgnoreOnError {
-		return ""
+		return nil, nil
 	}
 
-	if script.Output.Format == "nagios" {
+	switch script.Output.Format {
+	case "nagios":
 		return parseNagiosOutput(script, logger, output)
+	case "json":
+		return parseJSONOutput(script, logger, output)
+	case "influx":
+		return parseInfluxOutput(script, logger, output)
 	}
 
-	var formattedOutput string
+	return parsePrometheusOutput(script, logger, output)
+}
+
+// parsePrometheusOutput parses the output of a script in the Prometheus text
+// format. The output is parsed as a whole, so that the context between the
+// "# HELP" and "# TYPE" lines and the samples is kept. When the parser returns
+// an error for a line, the line is dropped and the parser continues after this
+// line. The "# HELP" and "# TYPE" lines, which were seen last before the
+// dropped line, are passed to the parser again, so that the following samples
+// keep their metric family.
+func parsePrometheusOutput(script *config.Script, logger *slog.Logger, output string) ([]*dto.MetricFamily, []string) {
+	logger.Debug("Validating script output", slog.String("script", script.Name), slog.String("output", output))
+
+	// The offsets of the lines are used to pass the remaining output to the
+	// parser without copying it.
+	lines := strings.Split(output, "\n")
+	offsets := make([]int, len(lines)+1)
+	for i, line := range lines {
+		offsets[i+1] = offsets[i] + len(line) + 1
+	}
+	metricFamilies := make(map[string]*dto.MetricFamily)
+
+	var validationErrors []string
+	var header []string
+
+	for start := 0; start < len(lines); {
+		parsedMetricFamilies, err := parseText(header, output[offsets[start]:])
+		if err == nil {
+			validationErrors = append(validationErrors, mergeParsedMetricFamilies(script, metricFamilies, parsedMetricFamilies)...)
+			break
+		}
+
+		// If the parser didn't return the line which caused the error, we can
+		// not continue with the remaining lines, so that they are dropped.
+		var parseErr expfmt.ParseError
+		if !errors.As(err, &parseErr) || parseErr.Line < 1 || parseErr.Line > len(header)+len(lines)-start {
+			logger.Debug("Error parsing metric families", slog.String("script", script.Name), slog.Any("error", err))
+			metricOutputDroppedLinesTotal.WithLabelValues(script.Name).Add(float64(len(lines) - start))
+			validationErrors = append(validationErrors, err.Error())
+			break
+		}
 
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	for scanner.Scan() {
-		if len(scanner.Text()) == 0 {
+		// The header lines were already parsed without an error before, so
+		// this should not happen. To be safe the header lines are dropped.
+		if parseErr.Line <= len(header) {
+			header = nil
 			continue
 		}
 
-		if isValidOutput(script, fmt.Sprintf("%s\n", scanner.Text()), logger) {
-			formattedOutput += fmt.Sprintf("%s\n", scanner.Text())
+		line := start + parseErr.Line - len(header) - 1
+
+		logger.Debug("Error parsing metric families", slog.String("script", script.Name), slog.Int("line", line+1), slog.String("output", lines[line]), slog.Any("error", parseErr.Msg))
+		metricOutputDroppedLinesTotal.WithLabelValues(script.Name).Inc()
+		validationErrors = append(validationErrors, fmt.Sprintf("line %d: %s: %q", line+1, parseErr.Msg, lines[line]))
+
+		// The lines before the invalid line are parsed again, because the
+		// parser might already have added parts of the invalid line to the
+		// returned metric families.
+		parsedMetricFamilies, err = parseText(header, output[offsets[start]:offsets[line]])
+		if err == nil {
+			validationErrors = append(validationErrors, mergeParsedMetricFamilies(script, metricFamilies, parsedMetricFamilies)...)
 		}
+
+		header = getHeaderLines(header, lines[start:line])
+		start = line + 1
 	}
 
-	return formattedOutput
+	return slices.SortedFunc(maps.Values(metricFamilies), func(a, b *dto.MetricFamily) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	}), validationErrors
 }
 
-func isValidOutput(script *config.Script, output string, logger *slog.Logger) bool {
-	logger.Debug("Validating script output", slog.String("script", script.Name), slog.String("output", output))
+// getHeaderLines returns the "# HELP" and "# TYPE" lines, which were seen last
+// in the provided lines. If the lines do not contain such a line, the provided
+// header line is kept.
+func getHeaderLines(header []string, lines []string) []string {
+	var help, typ string
+	for _, line := range header {
+		if strings.HasPrefix(strings.TrimSpace(line), "# HELP ") {
+			help = line
+		} else {
+			typ = line
+		}
+	}
+
+	for _, line := range lines {
+		switch trimmedLine := strings.TrimSpace(line); {
+		case strings.HasPrefix(trimmedLine, "# HELP "):
+			help = line
+		case strings.HasPrefix(trimmedLine, "# TYPE "):
+			typ = line
+		}
+	}
+
+	var headerLines []string
+	for _, line := range []string{help, typ} {
+		if line != "" {
+			headerLines = append(headerLines, line)
+		}
+	}
+
+	return headerLines
+}
 
+// mergeParsedMetricFamilies merges metric families, which were parsed from a
+// part of the output of a script, into the provided metric families. The
+// samples of a histogram or summary might be split across multiple parts, so
+// that they are merged into a single metric. Metric families with a different
+// type than the already parsed metric family with the same name are dropped.
+func mergeParsedMetricFamilies(script *config.Script, metricFamilies, parsedMetricFamilies map[string]*dto.MetricFamily) []string {
+	var validationErrors []string
+
+	for name, parsedMetricFamily := range parsedMetricFamilies {
+		metricFamily, ok := metricFamilies[name]
+		if !ok {
+			metricFamilies[name] = parsedMetricFamily
+			continue
+		}
+
+		if metricFamily.GetType() != parsedMetricFamily.GetType() {
+			metricOutputDroppedLinesTotal.WithLabelValues(script.Name).Add(float64(len(parsedMetricFamily.GetMetric())))
+			validationErrors = append(validationErrors, fmt.Sprintf("metric family %s: type %s doesn't match type %s", name, parsedMetricFamily.GetType(), metricFamily.GetType()))
+			continue
+		}
+
+		for _, parsedMetric := range parsedMetricFamily.GetMetric() {
+			if parsedMetricFamily.GetType() == dto.MetricType_HISTOGRAM || parsedMetricFamily.GetType() == dto.MetricType_SUMMARY {
+				index := slices.IndexFunc(metricFamily.GetMetric(), func(metric *dto.Metric) bool {
+					return slices.EqualFunc(metric.GetLabel(), parsedMetric.GetLabel(), func(a, b *dto.LabelPair) bool {
+						return a.GetName() == b.GetName() && a.GetValue() == b.GetValue()
+					})
+				})
+				if index != -1 {
+					proto.Merge(metricFamily.Metric[index], parsedMetric)
+					continue
+				}
+			}
+
+			metricFamily.Metric = append(metricFamily.Metric, parsedMetric)
+		}
+	}
+
+	return validationErrors
+}
+
+// parseText parses the provided header lines followed by the provided text in
+// the Prometheus text format into metric families. Panics of the parser are
+// returned as error.
+func parseText(header []string, text string) (metricFamilies map[string]*dto.MetricFamily, err error) {
 	defer func() {
-		if recover() != nil {
-			return
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while parsing output: %v", r)
 		}
 	}()
 
-	parser := expfmt.NewTextParser(model.UTF8Validation)
-
-	_, err := parser.TextToMetricFamilies(strings.NewReader(output))
-	if err != nil {
-		logger.Debug("Error parsing metric families", slog.String("script", script.Name), slog.String("output", output), slog.Any("error", err))
-		return false
+	var headerText strings.Builder
+	for _, line := range header {
+		headerText.WriteString(line)
+		headerText.WriteString("\n")
 	}
 
-	return true
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	return parser.TextToMetricFamilies(io.MultiReader(strings.NewReader(headerText.String()), strings.NewReader(text)))
 }
 
-func parseNagiosOutput(script *config.Script, logger *slog.Logger, output string) string {
+func parseNagiosOutput(script *config.Script, logger *slog.Logger, output string) ([]*dto.MetricFamily, []string) {
 	nagiosParser := nagios.Parser{}
 	nagiosMetrics, err := nagiosParser.Parse([]byte(output))
 	if err != nil {
 		logger.Error("Error parsing Nagios output", slog.String("script", script.Name), slog.String("output", output), slog.Any("error", err))
-		return ""
+		return nil, []string{err.Error()}
 	}
 
 	collection := prometheusserializer.NewCollection(prometheusserializer.FormatConfig{
@@ -385,19 +904,5 @@ func parseNagiosOutput(script *config.Script, logger *slog.Logger, output string
 		collection.Add(metric, time.Now())
 	}
 
-	var formattedOutput string
-
-	prometheusMetrics := collection.GetProto()
-	for _, metric := range prometheusMetrics {
-		var buffer bytes.Buffer
-		encoder := expfmt.NewEncoder(&buffer, expfmt.NewFormat(expfmt.TypeTextPlain))
-		err := encoder.Encode(metric)
-		if err != nil {
-			logger.Error("Error encoding Prometheus metric", slog.String("script", script.Name), slog.Any("metric", metric), slog.Any("error", err))
-			continue
-		}
-		formattedOutput += buffer.String()
-	}
-
-	return formattedOutput
+	return collection.GetProto(), nil
 }
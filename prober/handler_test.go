@@ -2,17 +2,28 @@ package prober
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ricoberger/script_exporter/config"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
@@ -30,7 +41,7 @@ func TestHandler(t *testing.T) {
 		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
 		w := httptest.NewRecorder()
 
-		Handler(w, req, &c, logger, false, 0.5, false)
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -44,13 +55,306 @@ func TestHandler(t *testing.T) {
 		require.Contains(t, string(data), `script_cached{script="test"} 0`)
 	})
 
+	t.Run("should return metrics in the negotiated format", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    `te"st`,
+				Command: []string{"true"},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=te%22st", nil)
+		req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, res.Header.Get("Content-Type"), "application/openmetrics-text")
+		require.Contains(t, string(data), `script_success{script="te\"st"} 1`)
+		require.Contains(t, string(data), "# EOF")
+	})
+
+	t.Run("should parse output as a whole and drop invalid lines", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-dropped-lines",
+				Command: []string{"printf", "# HELP test_counter A test counter.\n# TYPE test_counter counter\ntest_counter{label=\"a\"} 1\ninvalid line\ntest_counter{label=\"b\"} 2\ntest_gauge 3,14\n"},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-dropped-lines", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), "# HELP test_counter A test counter.\n# TYPE test_counter counter\ntest_counter{label=\"a\"} 1\ntest_counter{label=\"b\"} 2")
+		require.NotContains(t, string(data), "invalid")
+		require.NotContains(t, string(data), "test_gauge")
+		require.Equal(t, float64(2), testutil.ToFloat64(metricOutputDroppedLinesTotal.WithLabelValues("test-dropped-lines")))
+	})
+
+	t.Run("should parse output with many invalid lines in linear time", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-many-dropped-lines",
+				Command: []string{"bash", "-c", "echo '# TYPE test_gauge gauge'; for i in $(seq 1 4000); do echo \"invalid line $i\"; echo \"test_gauge{index=\\\"$i\\\"} $i\"; done"},
+			}},
+		}
+
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-many-dropped-lines", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Less(t, time.Since(startTime).Seconds(), float64(2))
+		require.Equal(t, 1, strings.Count(string(data), "# TYPE test_gauge gauge\n"))
+		require.Equal(t, 4000, strings.Count(string(data), "test_gauge{index="))
+		require.Contains(t, string(data), `test_gauge{index="4000"} 4000`)
+		require.NotContains(t, string(data), "invalid")
+		require.Equal(t, float64(4000), testutil.ToFloat64(metricOutputDroppedLinesTotal.WithLabelValues("test-many-dropped-lines")))
+	})
+
+	t.Run("should merge histogram split by an invalid line", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-dropped-histogram-line",
+				Command: []string{"printf", "# TYPE test_histogram histogram\ntest_histogram_bucket{le=\"1\"} 1\ninvalid line\ntest_histogram_bucket{le=\"+Inf\"} 2\ntest_histogram_sum 3\ntest_histogram_count 2\n"},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-dropped-histogram-line", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), "test_histogram_bucket{le=\"1\"} 1\ntest_histogram_bucket{le=\"+Inf\"} 2\ntest_histogram_sum 3\ntest_histogram_count 2\n")
+	})
+
+	t.Run("should return metrics from json output", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test",
+				Command: []string{"./scripts/json.sh"},
+				Output: config.Output{
+					Format: "json",
+					JSON: []config.JSONMetric{{
+						Name:   "example_global_value",
+						Type:   "gauge",
+						Path:   "{.counter}",
+						Labels: map[string]string{"location": "planet-{$.location}"},
+					}, {
+						Name:   "example_value_count",
+						Help:   "Count of the values.",
+						Type:   "counter",
+						Path:   "{.values[*]}",
+						Labels: map[string]string{"id": "{.id}", "state": "{.state}"},
+						Value:  "{.count}",
+					}, {
+						Name:  "example_value_active",
+						Path:  "$.values[1]",
+						Value: "1",
+					}, {
+						Name:   "example_value_name",
+						Path:   "{.values[*]}",
+						Labels: map[string]string{"name": "{.name}"},
+						Value:  "{.count}",
+					}},
+				},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{script="test"} 1`)
+		require.Contains(t, string(data), "# TYPE example_global_value gauge\nexample_global_value{location=\"planet-mars\"} 1234")
+		require.Contains(t, string(data), "# HELP example_value_count Count of the values.\n# TYPE example_value_count counter")
+		require.Contains(t, string(data), `example_value_count{id="id-A",state="ACTIVE"} 1`)
+		require.Contains(t, string(data), `example_value_count{id="id-B",state="INACTIVE"} 2`)
+		require.Contains(t, string(data), `example_value_count{id="id-C",state="ACTIVE"} 3`)
+		require.Contains(t, string(data), "# TYPE example_value_active untyped\nexample_value_active 1")
+		require.NotContains(t, string(data), "example_value_name")
+	})
+
+	t.Run("should return metrics from influx output", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test",
+				Command: []string{"./scripts/influx.sh"},
+				Output: config.Output{
+					Format: "influx",
+				},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{script="test"} 1`)
+		require.Contains(t, string(data), `weather_temperature{location="us-midwest"} 82`)
+		require.Contains(t, string(data), `weather_temperature{condition="sunny",location="us-east"} 75`)
+		require.Contains(t, string(data), `weather_humidity{condition="sunny",location="us-east"} 64`)
+		require.NotContains(t, string(data), `invalid`)
+	})
+
+	t.Run("should add labels to all metrics", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test",
+				Command: []string{"./scripts/output.sh"},
+				Labels: map[string]string{
+					"env":     "production",
+					"target":  "{{ .Params.target }}",
+					"missing": "{{ .Params.missing }}",
+				},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test&target=example.com", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{env="production",script="test",target="example.com"} 1`)
+		require.Contains(t, string(data), `script_cached{env="production",script="test",target="example.com"} 0`)
+		require.Contains(t, string(data), `first_test{env="production",label1="test_1_label_1",target="example.com"} 1`)
+		require.Contains(t, string(data), `fifth{env="production",target="example.com"} 5`)
+		require.NotContains(t, string(data), `missing`)
+	})
+
+	t.Run("should relabel metrics from output", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test",
+				Command: []string{"./scripts/output.sh"},
+				MetricRelabelConfigs: []config.RelabelConfig{{
+					SourceLabels: []string{"__name__"},
+					Regex:        config.MustNewRegexp("second_.*"),
+					Action:       config.RelabelDrop,
+				}, {
+					SourceLabels: []string{"label1"},
+					Separator:    ";",
+					Regex:        config.MustNewRegexp("test_(.*)_label_1"),
+					TargetLabel:  "test",
+					Replacement:  "$1",
+					Action:       config.RelabelReplace,
+				}, {
+					Regex:  config.MustNewRegexp("label1"),
+					Action: config.RelabelLabelDrop,
+				}, {
+					SourceLabels: []string{"__name__"},
+					Separator:    ";",
+					Regex:        config.MustNewRegexp("(.*)"),
+					TargetLabel:  "__name__",
+					Replacement:  "relabeled_$1",
+					Action:       config.RelabelReplace,
+				}},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{script="test"} 1`)
+		require.Contains(t, string(data), `relabeled_first_test{test="1"} 1`)
+		require.Contains(t, string(data), `relabeled_fifth 5`)
+		require.NotContains(t, string(data), `second_test`)
+	})
+
+	t.Run("should return debug output", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test",
+				Command: []string{"sh", "-c", "echo 'test_metric 1'; echo 'invalid line'; echo 'test error' >&2; exit 1"},
+				Env:     map[string]string{"HELLO": "WORLD"},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test&debug=true", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+		require.Contains(t, string(data), "Script: test\n")
+		require.Contains(t, string(data), "Environment: HELLO, script\n")
+		require.Contains(t, string(data), "Exit Code: 1\n")
+		require.Contains(t, string(data), "Error: exit status 1\n")
+		require.Contains(t, string(data), "Stdout:\ntest_metric 1\ninvalid line\n")
+		require.Contains(t, string(data), "Stderr:\ntest error\n")
+		require.Contains(t, string(data), `line 2: `)
+		require.Contains(t, string(data), `script_success{script="test"} 0`)
+		require.NotContains(t, string(data), "debug")
+	})
+
 	t.Run("should return error if script is not found", func(t *testing.T) {
 		var c = config.Config{}
 
 		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
 		w := httptest.NewRecorder()
 
-		Handler(w, req, &c, logger, false, 0.5, false)
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -75,7 +379,7 @@ func TestHandler(t *testing.T) {
 		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
 		w := httptest.NewRecorder()
 
-		Handler(w, req, &c, logger, false, 0.5, false)
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -90,7 +394,7 @@ func TestHandler(t *testing.T) {
 		require.Less(t, time.Since(startTime).Seconds(), float64(2))
 	})
 
-	t.Run("should not enforce max timeout when wait delay is not set", func(t *testing.T) {
+	t.Run("should kill child processes when timeout is enforced", func(t *testing.T) {
 		var c = config.Config{
 			Scripts: []config.Script{{
 				Name:    "test",
@@ -107,7 +411,7 @@ func TestHandler(t *testing.T) {
 		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
 		w := httptest.NewRecorder()
 
-		Handler(w, req, &c, logger, false, 0.5, false)
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -119,7 +423,7 @@ func TestHandler(t *testing.T) {
 		require.Contains(t, string(data), `script_duration_seconds{script="test"}`)
 		require.Contains(t, string(data), `script_exit_code{script="test"} -1`)
 		require.Contains(t, string(data), `script_cached{script="test"} 0`)
-		require.Greater(t, time.Since(startTime).Seconds(), float64(2))
+		require.Less(t, time.Since(startTime).Seconds(), float64(2))
 	})
 
 	t.Run("should enforce max timeout when wait delay is set", func(t *testing.T) {
@@ -140,7 +444,7 @@ func TestHandler(t *testing.T) {
 		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
 		w := httptest.NewRecorder()
 
-		Handler(w, req, &c, logger, false, 0.5, false)
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -155,20 +459,26 @@ func TestHandler(t *testing.T) {
 		require.Less(t, time.Since(startTime).Seconds(), float64(2))
 	})
 
-	t.Run("should use parameters as arguments and set environemnt variables", func(t *testing.T) {
+	t.Run("should send kill signal when timeout is enforced", func(t *testing.T) {
+		gracePeriod := float64(5)
 		var c = config.Config{
 			Scripts: []config.Script{{
-				Name:    "test",
-				Command: []string{"sleep"},
-				Env:     map[string]string{"HELOL": "WORLD"},
+				Name:    "test-kill-signal",
+				Command: []string{"bash", "-c", "trap 'echo cleanup; exit 1' USR1; sleep 5 & wait"},
+				Timeout: config.Timeout{
+					MaxTimeout:  1,
+					Enforced:    true,
+					KillSignal:  "SIGUSR1",
+					GracePeriod: &gracePeriod,
+				},
 			}},
 		}
 
 		startTime := time.Now()
-		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test&params=seconds&seconds=5", nil)
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-kill-signal&debug=true", nil)
 		w := httptest.NewRecorder()
 
-		Handler(w, req, &c, logger, false, 0.5, false)
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -176,51 +486,1047 @@ func TestHandler(t *testing.T) {
 
 		require.NoError(t, err)
 		require.Equal(t, http.StatusOK, res.StatusCode)
-		require.Contains(t, string(data), `script_success{script="test"} 1`)
-		require.Contains(t, string(data), `script_duration_seconds{script="test"}`)
-		require.Contains(t, string(data), `script_exit_code{script="test"} 0`)
-		require.Contains(t, string(data), `script_cached{script="test"} 0`)
-		require.Greater(t, time.Since(startTime).Seconds(), float64(5))
+		require.Contains(t, string(data), "Stdout:\ncleanup\n")
+		require.Less(t, time.Since(startTime).Seconds(), float64(2))
+		require.Equal(t, float64(0), testutil.ToFloat64(metricForceKilledTotal.WithLabelValues("test-kill-signal")))
 	})
 
-	t.Run("should cache result", func(t *testing.T) {
-		cacheDuration := float64(10)
+	t.Run("should not kill process group after script exited", func(t *testing.T) {
+		gracePeriod := float64(0.5)
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-exited",
+				Command: []string{"bash", "-c", "trap 'exit 1' TERM; sleep 5 & wait"},
+				Timeout: config.Timeout{
+					MaxTimeout:  1,
+					Enforced:    true,
+					GracePeriod: &gracePeriod,
+				},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-exited", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+
+		require.Equal(t, http.StatusOK, res.StatusCode)
 
+		time.Sleep(time.Duration(2*gracePeriod) * time.Second)
+		require.Equal(t, float64(0), testutil.ToFloat64(metricForceKilledTotal.WithLabelValues("test-exited")))
+	})
+
+	t.Run("should kill remaining processes when script exited", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "pid")
+		gracePeriod := float64(5)
 		var c = config.Config{
 			Scripts: []config.Script{{
-				Name:    "test",
-				Command: []string{"sleep"},
-				Args:    []string{"5"},
-				Cache: config.Cache{
-					Duration: &cacheDuration,
+				Name:    "test-kill-remaining",
+				Command: []string{"bash", "-c", "trap 'exit 1' TERM; (trap '' TERM; echo $BASHPID > " + pidFile + "; exec sleep 10) & wait"},
+				Timeout: config.Timeout{
+					MaxTimeout:  1,
+					Enforced:    true,
+					WaitDelay:   0.2,
+					GracePeriod: &gracePeriod,
 				},
 			}},
 		}
 
-		// Uncached
-		startTime1 := time.Now()
-		req1, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
-		w1 := httptest.NewRecorder()
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-kill-remaining", nil)
+		w := httptest.NewRecorder()
 
-		Handler(w1, req1, &c, logger, false, 0.5, false)
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
 
-		res1 := w1.Result()
-		defer res1.Body.Close()
+		require.Less(t, time.Since(startTime).Seconds(), float64(3))
 
-		require.Equal(t, http.StatusOK, res1.StatusCode)
-		require.Greater(t, time.Since(startTime1).Seconds(), float64(5))
+		data, err := os.ReadFile(pidFile)
+		require.NoError(t, err)
 
-		// Cached
-		startTime2 := time.Now()
-		req2, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
-		w2 := httptest.NewRecorder()
+		// The killed process might still exist as zombie, until it is reaped
+		// by its new parent process.
+		require.Eventually(t, func() bool {
+			stat, err := os.ReadFile("/proc/" + strings.TrimSpace(string(data)) + "/stat")
+			return err != nil || strings.Contains(string(stat), ") Z ")
+		}, time.Second, 10*time.Millisecond)
+	})
 
-		Handler(w2, req2, &c, logger, false, 0.5, false)
+	t.Run("should kill script after grace period", func(t *testing.T) {
+		gracePeriod := float64(0.5)
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-force-kill",
+				Command: []string{"bash", "-c", "trap '' TERM; sleep 5"},
+				Timeout: config.Timeout{
+					MaxTimeout:  1,
+					Enforced:    true,
+					GracePeriod: &gracePeriod,
+				},
+			}},
+		}
 
-		res2 := w2.Result()
-		defer res2.Body.Close()
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-force-kill", nil)
+		w := httptest.NewRecorder()
 
-		require.Equal(t, http.StatusOK, res2.StatusCode)
-		require.Less(t, time.Since(startTime2).Seconds(), float64(2))
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{script="test-force-kill"} 0`)
+		require.Greater(t, time.Since(startTime).Seconds(), float64(1.4))
+		require.Less(t, time.Since(startTime).Seconds(), float64(3))
+		require.Equal(t, float64(1), testutil.ToFloat64(metricForceKilledTotal.WithLabelValues("test-force-kill")))
+	})
+
+	t.Run("should report resource usage", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-usage",
+				Command: []string{"bash", "-c", "for i in $(seq 1 50000); do :; done; x=$(head -c 100000000 /dev/zero | tr '\\0' a)"},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-usage", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_cpu_user_seconds{script="test-usage"}`)
+		require.Contains(t, string(data), `script_cpu_system_seconds{script="test-usage"}`)
+		maxRSS := regexp.MustCompile(`script_max_rss_bytes{script="test-usage"} (\S+)`).FindStringSubmatch(string(data))
+		require.Len(t, maxRSS, 2)
+		maxRSSBytes, err := strconv.ParseFloat(maxRSS[1], 64)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, maxRSSBytes, float64(100000000))
+		require.Contains(t, string(data), `script_voluntary_context_switches{script="test-usage"}`)
+		require.Contains(t, string(data), `script_involuntary_context_switches{script="test-usage"}`)
+		require.Greater(t, testutil.ToFloat64(metricCPUUserSecondsTotal.WithLabelValues("test-usage"))+testutil.ToFloat64(metricCPUSystemSecondsTotal.WithLabelValues("test-usage")), float64(0))
+	})
+
+	t.Run("should apply resource limits and report used resources", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-resources",
+				Command: []string{"bash", "-c", "echo \"test_open_files $(ulimit -n)\"; echo \"test_address_space_kbytes $(ulimit -v)\"; echo \"test_cpu_seconds $(ulimit -t)\"; echo \"test_processes $(ulimit -u)\""},
+				Timeout: config.Timeout{
+					MaxTimeout: 10,
+				},
+				Resources: config.Resources{
+					MemoryMax:    1024 * 1024 * 1024,
+					CPUQuota:     0.5,
+					PidsMax:      1000,
+					MaxOpenFiles: 64,
+				},
+			}},
+		}
+
+		// SetupResources is not called, so that the test doesn't change the
+		// cgroup hierarchy of the host. The script is run without a cgroup.
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-resources", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{script="test-resources"} 1`)
+		require.Contains(t, string(data), `test_open_files 64`)
+		require.Contains(t, string(data), `test_address_space_kbytes 1.048576e+06`)
+		require.Contains(t, string(data), `test_cpu_seconds 5`)
+		require.Contains(t, string(data), `test_processes 1000`)
+		require.Regexp(t, `script_memory_peak_bytes{script="test-resources"} [1-9]`, string(data))
+		require.Contains(t, string(data), `script_cpu_seconds{script="test-resources"}`)
+	})
+
+	t.Run("should use parameters as arguments and set environemnt variables", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test",
+				Command: []string{"sleep"},
+				Env:     map[string]string{"HELOL": "WORLD"},
+			}},
+		}
+
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test&params=seconds&seconds=5", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{script="test"} 1`)
+		require.Contains(t, string(data), `script_duration_seconds{script="test"}`)
+		require.Contains(t, string(data), `script_exit_code{script="test"} 0`)
+		require.Contains(t, string(data), `script_cached{script="test"} 0`)
+		require.Greater(t, time.Since(startTime).Seconds(), float64(5))
+	})
+
+	t.Run("should run multiple scripts in parallel", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test1",
+				Command: []string{"sleep"},
+				Args:    []string{"2"},
+			}, {
+				Name:    "test2",
+				Command: []string{"sleep"},
+				Args:    []string{"2"},
+			}},
+		}
+
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test2&script=test1", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{script="test1"} 1`)
+		require.Contains(t, string(data), `script_success{script="test2"} 1`)
+		require.Less(t, strings.Index(string(data), `script_success{script="test1"}`), strings.Index(string(data), `script_success{script="test2"}`))
+		require.Less(t, time.Since(startTime).Seconds(), float64(3))
+	})
+
+	t.Run("should merge metric families of multiple scripts", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test1",
+				Command: []string{"./scripts/output.sh"},
+			}, {
+				Name:    "test2",
+				Command: []string{"./scripts/sleep.sh"},
+				Args:    []string{"0"},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test1&script=test2", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, 1, strings.Count(string(data), "# HELP script_success "))
+		require.Equal(t, 1, strings.Count(string(data), "# TYPE script_success "))
+		require.Contains(t, string(data), `script_success{script="test1"} 1`)
+		require.Contains(t, string(data), `script_success{script="test2"} 1`)
+		require.Contains(t, string(data), `first_test{label1="test_1_label_1"} 1`)
+		require.Contains(t, string(data), `sleep{seconds="0"} 1`)
+		require.NotContains(t, string(data), `fourth`)
+	})
+
+	t.Run("should merge metric families with different help texts", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test1",
+				Command: []string{"echo", "foo{x=\"1\"} 1"},
+			}, {
+				Name:    "test2",
+				Command: []string{"printf", "# HELP foo the foo\nfoo{x=\"2\"} 2\n"},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test1&script=test2", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `foo{x="1"} 1`)
+		require.Contains(t, string(data), `foo{x="2"} 2`)
+		require.NotContains(t, string(data), `the foo`)
+	})
+
+	t.Run("should limit the number of scripts run in parallel", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test1",
+				Command: []string{"sleep"},
+				Args:    []string{"1"},
+			}, {
+				Name:    "test2",
+				Command: []string{"sleep"},
+				Args:    []string{"1"},
+			}},
+		}
+
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test1&script=test2", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 1)
+
+		res := w.Result()
+		defer res.Body.Close()
+
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Greater(t, time.Since(startTime).Seconds(), float64(2))
+	})
+
+	t.Run("should reject script execution if queue is full", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:           "test-queue-reject",
+				Command:        []string{"sleep"},
+				Args:           []string{"2"},
+				MaxConcurrency: 1,
+				Queue:          config.Queue{Size: 1, OnFull: "reject"},
+			}},
+		}
+
+		// Each request uses a different offset for the sleep command, so that
+		// the concurrent executions are not deduplicated.
+		statusCodes := make([]int, 3)
+
+		var wg sync.WaitGroup
+		for i := range statusCodes {
+			wg.Go(func() {
+				time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+
+				req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-queue-reject&params=offset&offset=0."+strings.Repeat("0", i+1), nil)
+				w := httptest.NewRecorder()
+
+				Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+				statusCodes[i] = w.Result().StatusCode
+			})
+		}
+		wg.Wait()
+
+		require.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusServiceUnavailable}, statusCodes)
+		require.Equal(t, float64(1), testutil.ToFloat64(metricQueueRejectedTotal.WithLabelValues("test-queue-reject")))
+	})
+
+	t.Run("should wait for free execution slot if queue is full", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:           "test-queue-wait",
+				Command:        []string{"sleep"},
+				Args:           []string{"1"},
+				MaxConcurrency: 1,
+				Queue:          config.Queue{OnFull: "wait"},
+			}},
+		}
+
+		// Each request uses a different offset for the sleep command, so that
+		// the concurrent executions are not deduplicated.
+		startTime := time.Now()
+		statusCodes := make([]int, 2)
+
+		var wg sync.WaitGroup
+		for i := range statusCodes {
+			wg.Go(func() {
+				req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-queue-wait&params=offset&offset=0."+strings.Repeat("0", i+1), nil)
+				w := httptest.NewRecorder()
+
+				Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+				statusCodes[i] = w.Result().StatusCode
+			})
+		}
+		wg.Wait()
+
+		require.Equal(t, []int{http.StatusOK, http.StatusOK}, statusCodes)
+		require.Greater(t, time.Since(startTime).Seconds(), float64(2))
+	})
+
+	t.Run("should not reject queued deduplicated script execution when only one scraper disconnects", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:           "test-queue-disconnect",
+				Command:        []string{"sleep"},
+				Args:           []string{"1"},
+				MaxConcurrency: 1,
+				Queue:          config.Queue{OnFull: "wait"},
+			}},
+		}
+
+		// The first request occupies the execution slot. The second and third
+		// request are deduplicated and are waiting for a free slot, while the
+		// second request disconnects.
+		statusCodes := make([]int, 3)
+
+		var wg sync.WaitGroup
+		for i := range statusCodes {
+			wg.Go(func() {
+				time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+
+				ctx := context.Background()
+				if i == 1 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, 300*time.Millisecond)
+					defer cancel()
+				}
+
+				req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/probe?script=test-queue-disconnect&params=offset&offset=0."+strings.Repeat("0", min(i, 1)+1), nil)
+				w := httptest.NewRecorder()
+
+				Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+				statusCodes[i] = w.Result().StatusCode
+			})
+		}
+		wg.Wait()
+
+		require.Equal(t, http.StatusOK, statusCodes[0])
+		require.Equal(t, http.StatusOK, statusCodes[2])
+	})
+
+	t.Run("should deduplicate concurrent script executions", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-deduplicate",
+				Command: []string{"sh", "-c", "sleep 1; echo \"test_metric $$\""},
+			}},
+		}
+
+		outputs := make([]string, 3)
+
+		var wg sync.WaitGroup
+		for i := range outputs {
+			wg.Go(func() {
+				req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-deduplicate", nil)
+				w := httptest.NewRecorder()
+
+				Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+				res := w.Result()
+				defer res.Body.Close()
+				data, _ := io.ReadAll(res.Body)
+
+				outputs[i] = regexp.MustCompile(`test_metric \d+`).FindString(string(data))
+			})
+		}
+		wg.Wait()
+
+		require.NotEmpty(t, outputs[0])
+		require.Equal(t, outputs[0], outputs[1])
+		require.Equal(t, outputs[0], outputs[2])
+		require.Equal(t, float64(2), testutil.ToFloat64(metricDeduplicatedTotal.WithLabelValues("test-deduplicate")))
+	})
+
+	t.Run("should cancel script execution when the scraper disconnects", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-cancel",
+				Command: []string{"./scripts/sleep.sh"},
+				Args:    []string{"5"},
+				Timeout: config.Timeout{
+					CancelOnDisconnect: true,
+				},
+			}},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/probe?script=test-cancel", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		require.Less(t, time.Since(startTime).Seconds(), float64(2))
+		require.Contains(t, w.Body.String(), `script_success{script="test-cancel"} 0`)
+		require.Equal(t, float64(1), testutil.ToFloat64(metricCancelledTotal.WithLabelValues("test-cancel")))
+	})
+
+	t.Run("should not cancel deduplicated script execution when only one scraper disconnects", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-cancel-deduplicated",
+				Command: []string{"./scripts/sleep.sh"},
+				Args:    []string{"1"},
+				Timeout: config.Timeout{
+					CancelOnDisconnect: true,
+				},
+			}},
+		}
+
+		outputs := make([]string, 2)
+
+		var wg sync.WaitGroup
+		for i := range outputs {
+			wg.Go(func() {
+				ctx := context.Background()
+				if i == 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+					defer cancel()
+				} else {
+					time.Sleep(100 * time.Millisecond)
+				}
+
+				req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/probe?script=test-cancel-deduplicated", nil)
+				w := httptest.NewRecorder()
+
+				Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+				outputs[i] = w.Body.String()
+			})
+		}
+		wg.Wait()
+
+		require.Contains(t, outputs[1], `script_success{script="test-cancel-deduplicated"} 1`)
+		require.Contains(t, outputs[1], `sleep{seconds="1"} 1`)
+		require.Equal(t, float64(0), testutil.ToFloat64(metricCancelledTotal.WithLabelValues("test-cancel-deduplicated")))
+	})
+
+	t.Run("should return error if one of the scripts is not found", func(t *testing.T) {
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test",
+				Command: []string{"sleep"},
+				Args:    []string{"1"},
+			}},
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test&script=invalid", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, res.StatusCode)
+		require.NotContains(t, string(data), `script_success`)
+	})
+
+	t.Run("should cache result", func(t *testing.T) {
+		cacheDuration := float64(10)
+
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test",
+				Command: []string{"sleep"},
+				Args:    []string{"5"},
+				Cache: config.Cache{
+					Duration: &cacheDuration,
+				},
+			}},
+		}
+
+		// Uncached
+		startTime1 := time.Now()
+		req1, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
+		w1 := httptest.NewRecorder()
+
+		Handler(w1, req1, &c, logger, false, 0.5, false, 0)
+
+		res1 := w1.Result()
+		defer res1.Body.Close()
+
+		require.Equal(t, http.StatusOK, res1.StatusCode)
+		require.Greater(t, time.Since(startTime1).Seconds(), float64(5))
+
+		// Cached
+		startTime2 := time.Now()
+		req2, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test", nil)
+		w2 := httptest.NewRecorder()
+
+		Handler(w2, req2, &c, logger, false, 0.5, false, 0)
+
+		res2 := w2.Result()
+		defer res2.Body.Close()
+
+		require.Equal(t, http.StatusOK, res2.StatusCode)
+		require.Less(t, time.Since(startTime2).Seconds(), float64(2))
+	})
+
+	t.Run("should return age of cached result", func(t *testing.T) {
+		cacheDuration := float64(10)
+
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-cache-age",
+				Command: []string{"sh", "-c", "exit 3"},
+				Cache: config.Cache{
+					Duration:     &cacheDuration,
+					CacheOnError: true,
+				},
+			}},
+		}
+
+		req1, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-cache-age", nil)
+		w1 := httptest.NewRecorder()
+
+		Handler(w1, req1, &c, logger, false, 0.5, false, 0)
+
+		time.Sleep(1 * time.Second)
+
+		req2, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-cache-age", nil)
+		w2 := httptest.NewRecorder()
+
+		Handler(w2, req2, &c, logger, false, 0.5, false, 0)
+
+		res2 := w2.Result()
+		defer res2.Body.Close()
+		data, err := io.ReadAll(res2.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res2.StatusCode)
+		require.Contains(t, string(data), `script_cached{script="test-cache-age"} 1`)
+		require.Contains(t, string(data), `script_exit_code{script="test-cache-age"} 3`)
+		require.Regexp(t, `script_cache_age_seconds{script="test-cache-age"} 1\.\d+`, string(data))
+		require.Regexp(t, `script_last_run_timestamp_seconds{script="test-cache-age"} 1\.\d+e\+09`, string(data))
+	})
+}
+
+func TestHistory(t *testing.T) {
+	SetHistoryLimit(2)
+	defer SetHistoryLimit(0)
+	SetHistoryRedactParams([]string{"token"})
+	defer SetHistoryRedactParams(nil)
+
+	var c = config.Config{
+		Scripts: []config.Script{{
+			Name:    "test-history",
+			Command: []string{"sh", "-c", "echo \"test_metric $1\"; echo 'test error' >&2", "--"},
+		}},
+	}
+
+	for _, value := range []string{"1", "2", "3"} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-history&params=value&value="+value+"&token=secret", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+	}
+
+	t.Run("should return last probe executions as json", func(t *testing.T) {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "/api/v1/history?script=test-history", nil)
+		w := httptest.NewRecorder()
+
+		HistoryAPIHandler(w, req, logger)
+
+		res := w.Result()
+		defer res.Body.Close()
+
+		var entries []HistoryEntry
+		err := json.NewDecoder(res.Body).Decode(&entries)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Len(t, entries, 2)
+		require.Equal(t, "3", entries[0].Params.Get("value"))
+		require.Equal(t, "2", entries[1].Params.Get("value"))
+		require.Equal(t, "<redacted>", entries[0].Params.Get("token"))
+		require.Equal(t, "test-history", entries[0].Script)
+		require.True(t, entries[0].Success)
+		require.Equal(t, 0, entries[0].ExitCode)
+		require.Equal(t, "test_metric 3\n", entries[0].Stdout)
+		require.Equal(t, "test error\n", entries[0].Stderr)
+		require.Contains(t, entries[0].Metrics, "test_metric 3")
+	})
+
+	t.Run("should return last probe executions as html", func(t *testing.T) {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "/history", nil)
+		w := httptest.NewRecorder()
+
+		HistoryHandler(w, req, logger)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), "<td>test-history</td>")
+		require.Contains(t, string(data), "token=&lt;redacted&gt; value=3")
+		require.NotContains(t, string(data), "secret")
+		require.Contains(t, string(data), "test_metric 3")
+		require.NotContains(t, string(data), "test_metric 1")
+	})
+}
+
+func TestSchedule(t *testing.T) {
+	var c = config.Config{
+		Scripts: []config.Script{{
+			Name:    "test-schedule",
+			Command: []string{"sh", "-c", "sleep 1; echo \"test_metric $1\"", "--"},
+			Schedule: config.Schedule{
+				Interval:      60,
+				Params:        []map[string]string{{"params": "value", "value": "1"}},
+				ExposeMetrics: true,
+			},
+			Labels: map[string]string{"value": "{{ .Params.value }}"},
+		}, {
+			Name:    "test-schedule-duplicate",
+			Command: []string{"sh", "-c", "echo 'test_duplicate_metric 1'; echo 'test_duplicate_metric 2'"},
+			Schedule: config.Schedule{
+				Interval:      60,
+				ExposeMetrics: true,
+			},
+		}, {
+			Name:     "test-schedule-overrun",
+			Command:  []string{"sh", "-c", "sleep 1"},
+			Schedule: config.Schedule{Interval: 0.5},
+		}},
+	}
+
+	UpdateSchedules(&c, logger, false, 0.5, false)
+	defer UpdateSchedules(&config.Config{}, logger, false, 0.5, false)
+
+	time.Sleep(2 * time.Second)
+
+	t.Run("should return result of scheduled run", func(t *testing.T) {
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-schedule&params=value&value=1", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{script="test-schedule",value="1"} 1`)
+		require.Contains(t, string(data), `test_metric{value="1"} 1`)
+		require.Contains(t, string(data), `script_cached{script="test-schedule",value="1"} 1`)
+		require.Contains(t, string(data), `script_cache_age_seconds{script="test-schedule",value="1"}`)
+		require.Less(t, time.Since(startTime).Seconds(), float64(1))
+	})
+
+	t.Run("should count scheduled runs which took longer than the interval", func(t *testing.T) {
+		require.Greater(t, testutil.ToFloat64(metricScheduleOverrunsTotal.WithLabelValues("test-schedule-overrun")), float64(0))
+	})
+
+	t.Run("should expose metrics of scheduled run", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(NewScheduleCollector(logger))
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil)
+		w := httptest.NewRecorder()
+
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `script_success{script="test-schedule",value="1"} 1`)
+		require.Contains(t, string(data), `test_metric{value="1"} 1`)
+		require.Contains(t, string(data), `script_success{script="test-schedule-duplicate"} 1`)
+		require.Equal(t, 1, strings.Count(string(data), "\ntest_duplicate_metric "))
+	})
+
+	t.Run("should run script for parameters which are not scheduled", func(t *testing.T) {
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-schedule&params=value&value=2", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `test_metric{value="2"} 2`)
+		require.Greater(t, time.Since(startTime).Seconds(), float64(1))
+	})
+
+	t.Run("should run script when result of scheduled run is expired", func(t *testing.T) {
+		params := url.Values{"script": {"test-schedule"}, "params": {"value"}, "value": {"1"}}
+
+		scheduleLock.Lock()
+		s := schedules[getScheduleKey("test-schedule", params)]
+		resultTime := s.resultTime
+		s.resultTime = time.Now().Add(-2 * time.Minute)
+		scheduleLock.Unlock()
+		defer func() {
+			scheduleLock.Lock()
+			s.resultTime = resultTime
+			scheduleLock.Unlock()
+		}()
+
+		require.Nil(t, getScheduleResult(&c.Scripts[0], params))
+
+		startTime := time.Now()
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-schedule&params=value&value=1", nil)
+		w := httptest.NewRecorder()
+
+		Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, string(data), `test_metric{value="1"} 1`)
+		require.Contains(t, string(data), `script_cached{script="test-schedule",value="1"} 0`)
+		require.Greater(t, time.Since(startTime).Seconds(), float64(1))
+	})
+}
+
+// getCachedResult returns the result from the cache for the provided key and
+// ignores if the result should be refreshed.
+func getCachedResult(script *config.Script, key string, useExpiredCache bool) *scriptResult {
+	result, _ := getCacheResult(script, key, useExpiredCache)
+	return result
+}
+
+func TestCache(t *testing.T) {
+	cacheDuration := float64(10)
+	script := &config.Script{Name: "test-cache", Cache: config.Cache{Duration: &cacheDuration}}
+
+	t.Run("should use different keys for different inputs", func(t *testing.T) {
+		changedScript := &config.Script{Name: "test-cache", Args: []string{"--verbose"}, Cache: config.Cache{Duration: &cacheDuration}}
+		relabelScript := &config.Script{Name: "test-cache", MetricRelabelConfigs: []config.RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: config.MustNewRegexp("test_.*"), Action: config.RelabelDrop}}}
+
+		require.NotEqual(t, getCacheKey(script, []string{"a-b"}, nil), getCacheKey(script, []string{"a", "b"}, nil))
+		require.NotEqual(t, getCacheKey(script, nil, url.Values{"target": {"a"}}), getCacheKey(script, nil, url.Values{"target": {"b"}}))
+		require.NotEqual(t, getCacheKey(script, nil, nil), getCacheKey(changedScript, nil, nil))
+		require.Equal(t, getCacheKey(script, []string{"a"}, url.Values{"target": {"a"}}), getCacheKey(script, []string{"a"}, url.Values{"target": {"a"}}))
+		require.Equal(t, getCacheKey(relabelScript, nil, nil), getCacheKey(relabelScript, nil, nil))
+	})
+
+	t.Run("should create key for relabel config without regex", func(t *testing.T) {
+		relabelScript := &config.Script{Name: "test-cache", MetricRelabelConfigs: []config.RelabelConfig{{Action: config.RelabelLabelDrop}}, Cache: config.Cache{Duration: &cacheDuration}}
+
+		require.NotPanics(t, func() { getCacheKey(relabelScript, nil, nil) })
+		require.NotEqual(t, getCacheKey(script, nil, nil), getCacheKey(relabelScript, nil, nil))
+	})
+
+	t.Run("should evict least recently used entries", func(t *testing.T) {
+		SetCacheLimits(2, 0)
+		defer SetCacheLimits(0, 0)
+
+		setCacheResult(script, getCacheKey(script, []string{"1"}, nil), scriptResult{stdout: "1"})
+		setCacheResult(script, getCacheKey(script, []string{"2"}, nil), scriptResult{stdout: "2"})
+		require.NotNil(t, getCachedResult(script, getCacheKey(script, []string{"1"}, nil), false))
+
+		setCacheResult(script, getCacheKey(script, []string{"3"}, nil), scriptResult{stdout: "3"})
+
+		require.NotNil(t, getCachedResult(script, getCacheKey(script, []string{"1"}, nil), false))
+		require.Nil(t, getCachedResult(script, getCacheKey(script, []string{"2"}, nil), false))
+		require.NotNil(t, getCachedResult(script, getCacheKey(script, []string{"3"}, nil), false))
+		require.Equal(t, float64(2), testutil.ToFloat64(metricCacheEntries.WithLabelValues("test-cache")))
+		require.Equal(t, float64(1), testutil.ToFloat64(metricCacheEvictionsTotal.WithLabelValues("test-cache", "size")))
+		require.Equal(t, float64(1), testutil.ToFloat64(metricCacheMissesTotal.WithLabelValues("test-cache")))
+	})
+
+	t.Run("should evict entries when max bytes are reached", func(t *testing.T) {
+		SetCacheLimits(0, 10)
+		defer SetCacheLimits(0, 0)
+
+		setCacheResult(script, getCacheKey(script, []string{"4"}, nil), scriptResult{stdout: "12345"})
+		setCacheResult(script, getCacheKey(script, []string{"5"}, nil), scriptResult{stdout: "12345"})
+		setCacheResult(script, getCacheKey(script, []string{"6"}, nil), scriptResult{stdout: "12345678901"})
+
+		require.NotNil(t, getCachedResult(script, getCacheKey(script, []string{"4"}, nil), false))
+		require.NotNil(t, getCachedResult(script, getCacheKey(script, []string{"5"}, nil), false))
+		require.Nil(t, getCachedResult(script, getCacheKey(script, []string{"6"}, nil), false))
+
+		setCacheResult(script, getCacheKey(script, []string{"6"}, nil), scriptResult{stdout: "1"})
+
+		require.Nil(t, getCachedResult(script, getCacheKey(script, []string{"4"}, nil), false))
+		require.NotNil(t, getCachedResult(script, getCacheKey(script, []string{"6"}, nil), false))
+	})
+
+	t.Run("should restore persisted entries", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, SetCacheDir(dir, logger))
+		defer func() { store = nil }()
+
+		// restart simulates a restart of the exporter, by removing all entries
+		// from memory, before the entries are loaded from the directory again.
+		restart := func() {
+			FlushCache()
+			store = nil
+			cacheLock.Lock()
+			for _, element := range cache.entries {
+				removeCacheEntry(element, "")
+			}
+			cacheLock.Unlock()
+			require.Nil(t, getCachedResult(script, getCacheKey(script, []string{"persisted"}, nil), false))
+
+			require.NoError(t, SetCacheDir(dir, logger))
+		}
+
+		metrics, _ := parsePrometheusOutput(script, logger, "test_metric{label=\"value\"} 1\n")
+		result := scriptResult{startTime: time.Now(), success: 1, stdout: "persisted", metrics: metrics}
+		setCacheResult(script, getCacheKey(script, []string{"persisted"}, nil), result)
+		setCacheResult(script, getCacheKey(script, []string{"replaced"}, nil), scriptResult{stdout: "replaced"})
+		restart()
+
+		cachedResult := getCachedResult(script, getCacheKey(script, []string{"persisted"}, nil), false)
+		require.NotNil(t, cachedResult)
+		require.Equal(t, "persisted", cachedResult.stdout)
+		require.True(t, result.startTime.Equal(cachedResult.startTime))
+		require.Len(t, cachedResult.metrics, 1)
+		require.True(t, proto.Equal(metrics[0], cachedResult.metrics[0]))
+		require.NotNil(t, getCachedResult(script, getCacheKey(script, []string{"replaced"}, nil), false))
+
+		// A replacement which is larger than the cache isn't cached, but the
+		// replaced entry must also be removed from the store.
+		SetCacheLimits(0, 1024)
+		defer SetCacheLimits(0, 0)
+
+		setCacheResult(script, getCacheKey(script, []string{"replaced"}, nil), scriptResult{stdout: strings.Repeat("x", 2048)})
+		require.Nil(t, getCachedResult(script, getCacheKey(script, []string{"replaced"}, nil), false))
+		restart()
+
+		require.NotNil(t, getCachedResult(script, getCacheKey(script, []string{"persisted"}, nil), false))
+		require.Nil(t, getCachedResult(script, getCacheKey(script, []string{"replaced"}, nil), false))
+	})
+
+	t.Run("should return stale entries and refresh them in the background", func(t *testing.T) {
+		swrCacheDuration := float64(1)
+		var c = config.Config{
+			Scripts: []config.Script{{
+				Name:    "test-cache-swr",
+				Command: []string{"sh", "-c", "sleep 1; echo \"test_metric $(date +%s%N)\""},
+				Cache:   config.Cache{Duration: &swrCacheDuration, StaleWhileRevalidate: 60},
+			}},
+		}
+
+		probe := func() (string, float64) {
+			startTime := time.Now()
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "/probe?script=test-cache-swr", nil)
+			w := httptest.NewRecorder()
+
+			Handler(w, req, &c, logger, false, 0.5, false, 0)
+
+			res := w.Result()
+			defer res.Body.Close()
+			data, _ := io.ReadAll(res.Body)
+
+			for line := range strings.Lines(string(data)) {
+				if strings.HasPrefix(line, "test_metric ") {
+					return line, time.Since(startTime).Seconds()
+				}
+			}
+			return "", time.Since(startTime).Seconds()
+		}
+
+		// Uncached
+		output1, duration1 := probe()
+		require.Greater(t, duration1, float64(1))
+
+		// Stale, the cached result is returned and refreshed in the background
+		time.Sleep(1 * time.Second)
+		output2, duration2 := probe()
+		require.Less(t, duration2, float64(1))
+		require.Equal(t, output1, output2)
+		require.Equal(t, float64(1), testutil.ToFloat64(metricCacheRevalidationsTotal.WithLabelValues("test-cache-swr")))
+
+		// Refreshed
+		time.Sleep(1500 * time.Millisecond)
+		output3, duration3 := probe()
+		require.Less(t, duration3, float64(1))
+		require.NotEqual(t, output1, output3)
+	})
+
+	t.Run("should evict expired entries", func(t *testing.T) {
+		expiredCacheDuration := float64(0)
+		expiredScript := &config.Script{Name: "test-cache-expired", Cache: config.Cache{Duration: &expiredCacheDuration}}
+		staleScript := &config.Script{Name: "test-cache-stale", Cache: config.Cache{Duration: &expiredCacheDuration, UseExpiredCacheOnError: true}}
+
+		setCacheResult(expiredScript, getCacheKey(expiredScript, nil, nil), scriptResult{stdout: "1"})
+		setCacheResult(staleScript, getCacheKey(staleScript, nil, nil), scriptResult{stdout: "1"})
+
+		require.Nil(t, getCachedResult(expiredScript, getCacheKey(expiredScript, nil, nil), false))
+		require.Nil(t, getCachedResult(expiredScript, getCacheKey(expiredScript, nil, nil), true))
+		require.Nil(t, getCachedResult(staleScript, getCacheKey(staleScript, nil, nil), false))
+		require.NotNil(t, getCachedResult(staleScript, getCacheKey(staleScript, nil, nil), true))
+		require.Equal(t, float64(0), testutil.ToFloat64(metricCacheEntries.WithLabelValues("test-cache-expired")))
+		require.Equal(t, float64(1), testutil.ToFloat64(metricCacheEvictionsTotal.WithLabelValues("test-cache-expired", "expired")))
+		require.Equal(t, float64(1), testutil.ToFloat64(metricCacheStaleServesTotal.WithLabelValues("test-cache-stale")))
+	})
+
+	t.Run("should list and invalidate entries", func(t *testing.T) {
+		c := &config.Config{Scripts: []config.Script{{Name: "test-cache-invalidate", Cache: config.Cache{Duration: &cacheDuration}}}}
+		invalidateScript := &c.Scripts[0]
+
+		paramsA := url.Values{"script": {"test-cache-invalidate"}, "target": {"a"}}
+		paramsB := url.Values{"script": {"test-cache-invalidate"}, "target": {"b"}}
+		setCacheResult(invalidateScript, getCacheKey(invalidateScript, nil, paramsA), scriptResult{success: 1, stdout: "a"})
+		setCacheResult(invalidateScript, getCacheKey(invalidateScript, nil, paramsB), scriptResult{success: 1, stdout: "b"})
+
+		invalidate := func(query string) string {
+			req := httptest.NewRequest(http.MethodPost, "/-/cache/invalidate?"+query, nil)
+			w := httptest.NewRecorder()
+			CacheInvalidateHandler(w, req, c, logger, false)
+			require.Equal(t, http.StatusOK, w.Code)
+			return w.Body.String()
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/-/cache?script=test-cache-invalidate", nil)
+		w := httptest.NewRecorder()
+		CacheHandler(w, req, logger)
+
+		var entries []CacheEntry
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		require.Len(t, entries, 2)
+		require.Equal(t, getCacheKey(invalidateScript, nil, paramsB), entries[0].Key)
+		require.Equal(t, "test-cache-invalidate", entries[0].Script)
+		require.True(t, entries[0].Success)
+		require.False(t, entries[0].Expired)
+
+		req = httptest.NewRequest(http.MethodGet, "/-/cache/invalidate", nil)
+		w = httptest.NewRecorder()
+		CacheInvalidateHandler(w, req, c, logger, false)
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+		require.Equal(t, "Invalidated 1 cache entries.\n", invalidate(paramsA.Encode()))
+		require.Nil(t, getCachedResult(invalidateScript, getCacheKey(invalidateScript, nil, paramsA), false))
+		require.NotNil(t, getCachedResult(invalidateScript, getCacheKey(invalidateScript, nil, paramsB), false))
+
+		setCacheResult(script, getCacheKey(script, []string{"invalidate"}, nil), scriptResult{stdout: "invalidate"})
+
+		require.Equal(t, "Invalidated 1 cache entries.\n", invalidate("script=test-cache-invalidate"))
+		require.Nil(t, getCachedResult(invalidateScript, getCacheKey(invalidateScript, nil, paramsB), false))
+		require.NotNil(t, getCachedResult(script, getCacheKey(script, []string{"invalidate"}, nil), false))
+
+		invalidate("")
+		require.Nil(t, getCachedResult(script, getCacheKey(script, []string{"invalidate"}, nil), false))
+		require.Equal(t, float64(2), testutil.ToFloat64(metricCacheEvictionsTotal.WithLabelValues("test-cache-invalidate", "invalidated")))
 	})
 }
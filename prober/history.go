@@ -0,0 +1,239 @@
+package prober
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+var history map[string]*historyBuffer
+var historyLimit int
+var historyRedactParams []string
+var historyLock = sync.RWMutex{}
+
+// historyRedacted replaces the values of the parameters, which should not be
+// kept in the history.
+const historyRedacted = "<redacted>"
+
+// HistoryEntry is a single probe execution of a script, which is kept in the
+// history, so that it can be inspected via the "/history" page and the
+// "/api/v1/history" endpoint.
+type HistoryEntry struct {
+	Timestamp        time.Time  `json:"timestamp"`
+	Script           string     `json:"script"`
+	Params           url.Values `json:"params"`
+	Success          bool       `json:"success"`
+	ExitCode         int        `json:"exitCode"`
+	Duration         float64    `json:"duration"`
+	Cached           bool       `json:"cached"`
+	Stdout           string     `json:"stdout"`
+	Stderr           string     `json:"stderr"`
+	Error            string     `json:"error,omitempty"`
+	ValidationErrors []string   `json:"validationErrors,omitempty"`
+	Metrics          string     `json:"metrics"`
+}
+
+// historyBuffer is a ring buffer, which contains the last probe executions of
+// a single script.
+type historyBuffer struct {
+	entries []HistoryEntry
+	next    int
+}
+
+func (b *historyBuffer) add(entry HistoryEntry, limit int) {
+	if len(b.entries) < limit {
+		b.entries = append(b.entries, entry)
+		return
+	}
+
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % limit
+}
+
+// list returns the entries of the buffer, with the newest entry first.
+func (b *historyBuffer) list() []HistoryEntry {
+	n := len(b.entries)
+	entries := make([]HistoryEntry, 0, n)
+	for i := range n {
+		entries = append(entries, b.entries[((b.next-1-i)%n+n)%n])
+	}
+	return entries
+}
+
+// SetHistoryLimit sets the number of probe executions, which are kept per
+// script. If the limit is 0, no history is kept. Setting the limit clears the
+// existing history.
+func SetHistoryLimit(limit int) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	historyLimit = limit
+	history = nil
+}
+
+// SetHistoryRedactParams sets the names of the parameters, which values are
+// not kept in the history, because they might contain secrets.
+func SetHistoryRedactParams(params []string) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	historyRedactParams = params
+}
+
+// addHistoryEntry adds the result of a script execution to the history. The
+// values of the parameters, which should be redacted, are not stored.
+func addHistoryEntry(script *config.Script, params url.Values, result scriptResult) {
+	historyLock.RLock()
+	limit := historyLimit
+	redactParams := historyRedactParams
+	historyLock.RUnlock()
+
+	if limit <= 0 {
+		return
+	}
+
+	var metrics strings.Builder
+	encoder := expfmt.NewEncoder(&metrics, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, metricFamily := range result.metrics {
+		//nolint:errcheck
+		encoder.Encode(metricFamily)
+	}
+
+	historyParams := make(url.Values, len(params))
+	for key, values := range params {
+		if slices.Contains(redactParams, key) {
+			values = slices.Repeat([]string{historyRedacted}, len(values))
+		}
+		historyParams[key] = slices.Clone(values)
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	// The limit is checked again, because the history might have been
+	// disabled, while the metrics were encoded.
+	if historyLimit <= 0 {
+		return
+	}
+
+	if history == nil {
+		history = make(map[string]*historyBuffer)
+	}
+
+	buffer, ok := history[script.Name]
+	if !ok {
+		buffer = &historyBuffer{}
+		history[script.Name] = buffer
+	}
+
+	buffer.add(HistoryEntry{
+		Timestamp:        result.startTime,
+		Script:           script.Name,
+		Params:           historyParams,
+		Success:          result.success == 1,
+		ExitCode:         result.exitCode,
+		Duration:         result.duration,
+		Cached:           result.cached == 1,
+		Stdout:           result.stdout,
+		Stderr:           result.stderr,
+		Error:            result.err,
+		ValidationErrors: result.validationErrors,
+		Metrics:          metrics.String(),
+	}, historyLimit)
+}
+
+// getHistoryEntries returns the history entries for the provided script, with
+// the newest entry first. If no script is provided the entries of all scripts
+// are returned.
+func getHistoryEntries(scriptName string) []HistoryEntry {
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	var entries []HistoryEntry
+	for _, name := range slices.Sorted(maps.Keys(history)) {
+		if scriptName == "" || scriptName == name {
+			entries = append(entries, history[name].list()...)
+		}
+	}
+
+	slices.SortStableFunc(entries, func(a, b HistoryEntry) int {
+		return b.Timestamp.Compare(a.Timestamp)
+	})
+
+	return entries
+}
+
+var historyTemplate = template.Must(template.New("history").Parse(`<html>
+<head><title>Script Exporter - History</title></head>
+<body>
+<h1>Recent Probes</h1>
+<table border='1'>
+<tr><th>Timestamp</th><th>Script</th><th>Params</th><th>Result</th><th>Exit Code</th><th>Duration</th><th>Cached</th><th>Details</th></tr>
+{{- range . }}
+<tr>
+<td>{{ .Timestamp.Format "2006-01-02T15:04:05Z07:00" }}</td>
+<td>{{ .Script }}</td>
+<td>{{ range $key, $values := .Params }}{{ range $values }}{{ $key }}={{ . }} {{ end }}{{ end }}</td>
+<td>{{ if .Success }}Success{{ else }}<strong>Failure</strong>{{ end }}</td>
+<td>{{ .ExitCode }}</td>
+<td>{{ printf "%.3f" .Duration }}s</td>
+<td>{{ .Cached }}</td>
+<td>
+<details>
+<summary>Show</summary>
+{{- if .Error }}
+<h4>Error</h4>
+<pre>{{ .Error }}</pre>
+{{- end }}
+<h4>Stdout</h4>
+<pre>{{ .Stdout }}</pre>
+<h4>Stderr</h4>
+<pre>{{ .Stderr }}</pre>
+{{- if .ValidationErrors }}
+<h4>Validation Errors</h4>
+<pre>{{ range .ValidationErrors }}{{ . }}
+{{ end }}</pre>
+{{- end }}
+<h4>Metrics</h4>
+<pre>{{ .Metrics }}</pre>
+</details>
+</td>
+</tr>
+{{- end }}
+</table>
+</body>
+</html>`))
+
+// HistoryHandler renders a HTML page with the last probe executions of all
+// scripts or of the script provided via the "script" parameter.
+func HistoryHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	w.Header().Set("Content-Type", "text/html")
+	if err := historyTemplate.Execute(w, getHistoryEntries(r.URL.Query().Get("script"))); err != nil {
+		logger.Error("Error rendering history", slog.Any("error", err))
+	}
+}
+
+// HistoryAPIHandler returns the last probe executions of all scripts or of the
+// script provided via the "script" parameter as JSON.
+func HistoryAPIHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	entries := getHistoryEntries(r.URL.Query().Get("script"))
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		logger.Error("Error encoding history", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,88 @@
+package prober
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	"github.com/influxdata/line-protocol/v2/lineprotocol"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	prometheusserializer "github.com/influxdata/telegraf/plugins/serializers/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// parseInfluxOutput parses the output of a script in the InfluxDB line
+// protocol format, as it is used by the exec input plugin of Telegraf. Lines
+// which can not be parsed are dropped and returned as validation errors. String
+// fields are added as labels, unless the "string_fields" option is set to
+// "drop".
+func parseInfluxOutput(script *config.Script, logger *slog.Logger, output string) ([]*dto.MetricFamily, []string) {
+	collection := prometheusserializer.NewCollection(prometheusserializer.FormatConfig{
+		StringAsLabel:   script.Output.Influx.StringFields != "drop",
+		ExportTimestamp: false,
+	})
+
+	var validationErrors []string
+
+	// The decoder continues with the next line, when a line can not be parsed,
+	// so that the output has to be parsed only once.
+	decoder := lineprotocol.NewDecoderWithBytes([]byte(output))
+	now := time.Now()
+
+	for decoder.Next() {
+		influxMetric, err := decodeInfluxMetric(decoder, now)
+		if err != nil {
+			logger.Debug("Error parsing InfluxDB line protocol output", slog.String("script", script.Name), slog.Any("error", err))
+			metricOutputDroppedLinesTotal.WithLabelValues(script.Name).Inc()
+			validationErrors = append(validationErrors, err.Error())
+			continue
+		}
+
+		collection.Add(influxMetric, now)
+	}
+
+	return collection.GetProto(), validationErrors
+}
+
+// decodeInfluxMetric decodes the current line of the provided decoder into a
+// metric. Lines without a timestamp are using the provided time.
+func decodeInfluxMetric(decoder *lineprotocol.Decoder, now time.Time) (telegraf.Metric, error) {
+	measurement, err := decoder.Measurement()
+	if err != nil {
+		return nil, err
+	}
+	name := string(measurement)
+
+	tags := make(map[string]string)
+	for {
+		key, value, err := decoder.NextTag()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			break
+		}
+		tags[string(key)] = string(value)
+	}
+
+	fields := make(map[string]any)
+	for {
+		key, value, err := decoder.NextField()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			break
+		}
+		fields[string(key)] = value.Interface()
+	}
+
+	timestamp, err := decoder.Time(lineprotocol.Nanosecond, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return metric.New(name, tags, fields, timestamp), nil
+}
@@ -0,0 +1,303 @@
+package prober
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// jsonPathSegment is a single segment of a path, which is used to select values
+// from the JSON output of a script. A segment either selects a key of an
+// object, an index of an array or all elements of an object or array.
+type jsonPathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses a path to select values from a JSON document. The
+// supported syntax is a subset of JSONPath, which is also used by the
+// json_exporter. A path can be wrapped in curly braces and can start with "$"
+// for the root or "@" for the current element. Object keys are selected via
+// ".key" or "['key']", array indices via "[0]" and all elements via ".*" or
+// "[*]", e.g. "{.items[*].name}".
+func parseJSONPath(path string) ([]jsonPathSegment, error) {
+	path = strings.TrimSpace(path)
+	if strings.HasPrefix(path, "{") && strings.HasSuffix(path, "}") {
+		path = strings.TrimSpace(path[1 : len(path)-1])
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), "@")
+
+	var segments []jsonPathSegment
+
+	for len(path) > 0 {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end == -1 {
+				end = len(path)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in path")
+			}
+			if path[:end] == "*" {
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			} else {
+				segments = append(segments, jsonPathSegment{key: path[:end]})
+			}
+			path = path[end:]
+		case '[':
+			end := strings.Index(path, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("missing closing bracket in path")
+			}
+			selector := strings.TrimSpace(path[1:end])
+			path = path[end+1:]
+
+			switch {
+			case selector == "*":
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			case len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]:
+				segments = append(segments, jsonPathSegment{key: selector[1 : len(selector)-1]})
+			default:
+				index, err := strconv.Atoi(selector)
+				if err != nil {
+					return nil, fmt.Errorf("invalid array index %q in path", selector)
+				}
+				segments = append(segments, jsonPathSegment{index: index, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected character %q in path", path[0])
+		}
+	}
+
+	return segments, nil
+}
+
+// selectJSONPath returns all values from the provided JSON document, which are
+// matching the provided path segments.
+func selectJSONPath(data any, segments []jsonPathSegment) []any {
+	if len(segments) == 0 {
+		return []any{data}
+	}
+
+	segment := segments[0]
+
+	var children []any
+
+	switch value := data.(type) {
+	case map[string]any:
+		if segment.wildcard {
+			keys := make([]string, 0, len(value))
+			for key := range value {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+
+			for _, key := range keys {
+				children = append(children, value[key])
+			}
+		} else if child, ok := value[segment.key]; ok && !segment.isIndex {
+			children = append(children, child)
+		}
+	case []any:
+		if segment.wildcard {
+			children = value
+		} else if segment.isIndex {
+			index := segment.index
+			if index < 0 {
+				index = len(value) + index
+			}
+			if index >= 0 && index < len(value) {
+				children = append(children, value[index])
+			}
+		}
+	}
+
+	var values []any
+	for _, child := range children {
+		values = append(values, selectJSONPath(child, segments[1:])...)
+	}
+
+	return values
+}
+
+// renderJSONTemplate renders a template, where all paths in curly braces are
+// replaced with the value they are selecting, e.g. "planet-{.location}". Paths
+// starting with "$" are selecting the value from the root of the JSON document,
+// all other paths are relative to the current element. A path within the
+// template must select exactly one value.
+func renderJSONTemplate(root any, element any, template string) (string, error) {
+	var rendered strings.Builder
+
+	for {
+		start := strings.Index(template, "{")
+		if start == -1 {
+			rendered.WriteString(template)
+			return rendered.String(), nil
+		}
+
+		end := strings.Index(template[start:], "}")
+		if end == -1 {
+			return "", fmt.Errorf("missing closing brace in template %q", template)
+		}
+		end = start + end
+
+		path := strings.TrimSpace(template[start+1 : end])
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			return "", err
+		}
+
+		data := element
+		if strings.HasPrefix(path, "$") {
+			data = root
+		}
+
+		values := selectJSONPath(data, segments)
+		if len(values) != 1 {
+			return "", fmt.Errorf("path %q selected %d values instead of 1", template[start:end+1], len(values))
+		}
+
+		rendered.WriteString(template[:start])
+		rendered.WriteString(formatJSONValue(values[0]))
+		template = template[end+1:]
+	}
+}
+
+func formatJSONValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// getJSONMetricValue returns the value for a metric from the selected JSON
+// element. If no value is configured, the selected element itself is used as
+// value. Numbers, booleans and strings containing a number are supported.
+func getJSONMetricValue(root any, data any, value string) (float64, error) {
+	if value != "" {
+		rendered, err := renderJSONTemplate(root, data, value)
+		if err != nil {
+			return 0, err
+		}
+		data = rendered
+	}
+
+	switch v := data.(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	default:
+		return 0, fmt.Errorf("value of type %T is not a number", data)
+	}
+}
+
+func parseJSONOutput(script *config.Script, logger *slog.Logger, output string) ([]*dto.MetricFamily, []string) {
+	var data any
+	if err := json.Unmarshal([]byte(output), &data); err != nil {
+		logger.Error("Error parsing JSON output", slog.String("script", script.Name), slog.String("output", output), slog.Any("error", err))
+		return nil, []string{err.Error()}
+	}
+
+	var metricFamilies []*dto.MetricFamily
+	var validationErrors []string
+	metricFamiliesByName := make(map[string]*dto.MetricFamily)
+
+	for _, jsonMetric := range script.Output.JSON {
+		segments, err := parseJSONPath(jsonMetric.Path)
+		if err != nil {
+			logger.Error("Error parsing JSON path", slog.String("script", script.Name), slog.String("metric", jsonMetric.Name), slog.String("path", jsonMetric.Path), slog.Any("error", err))
+			validationErrors = append(validationErrors, fmt.Sprintf("metric %s: %s", jsonMetric.Name, err.Error()))
+			continue
+		}
+
+		metricFamily, ok := metricFamiliesByName[jsonMetric.Name]
+		if !ok {
+			metricFamily = &dto.MetricFamily{
+				Name: proto.String(jsonMetric.Name),
+				Help: proto.String(jsonMetric.Help),
+				Type: getJSONMetricType(jsonMetric.Type).Enum(),
+			}
+			metricFamiliesByName[jsonMetric.Name] = metricFamily
+			metricFamilies = append(metricFamilies, metricFamily)
+		}
+
+	elements:
+		for _, element := range selectJSONPath(data, segments) {
+			value, err := getJSONMetricValue(data, element, jsonMetric.Value)
+			if err != nil {
+				logger.Debug("Error getting JSON metric value", slog.String("script", script.Name), slog.String("metric", jsonMetric.Name), slog.Any("error", err))
+				validationErrors = append(validationErrors, fmt.Sprintf("metric %s: %s", jsonMetric.Name, err.Error()))
+				continue
+			}
+
+			metric := &dto.Metric{}
+
+			labelNames := make([]string, 0, len(jsonMetric.Labels))
+			for labelName := range jsonMetric.Labels {
+				labelNames = append(labelNames, labelName)
+			}
+			slices.Sort(labelNames)
+
+			for _, labelName := range labelNames {
+				labelValue, err := renderJSONTemplate(data, element, jsonMetric.Labels[labelName])
+				if err != nil {
+					logger.Debug("Error getting JSON metric label", slog.String("script", script.Name), slog.String("metric", jsonMetric.Name), slog.String("label", labelName), slog.Any("error", err))
+					validationErrors = append(validationErrors, fmt.Sprintf("metric %s: label %s: %s", jsonMetric.Name, labelName, err.Error()))
+					continue elements
+				}
+				metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(labelName), Value: proto.String(labelValue)})
+			}
+
+			switch metricFamily.GetType() {
+			case dto.MetricType_GAUGE:
+				metric.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+			case dto.MetricType_COUNTER:
+				metric.Counter = &dto.Counter{Value: proto.Float64(value)}
+			default:
+				metric.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+			}
+
+			metricFamily.Metric = append(metricFamily.Metric, metric)
+		}
+	}
+
+	return metricFamilies, validationErrors
+}
+
+func getJSONMetricType(metricType string) dto.MetricType {
+	switch metricType {
+	case "gauge":
+		return dto.MetricType_GAUGE
+	case "counter":
+		return dto.MetricType_COUNTER
+	default:
+		return dto.MetricType_UNTYPED
+	}
+}
@@ -0,0 +1,99 @@
+package prober
+
+import (
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// labelTemplateData is the data, which is available in the templates for the
+// labels of a script. The query parameters of a probe can be used via
+// "{{ .Params.<name> }}". If a query parameter is set multiple times, the
+// values are joined by a comma, like it is done for the environment variables.
+type labelTemplateData struct {
+	Params map[string]string
+}
+
+// renderLabels renders the templates for the labels of a script with the query
+// parameters of the probe. Labels which can not be rendered or which are
+// rendered to an empty value are skipped.
+func renderLabels(script *config.Script, logger *slog.Logger, params url.Values) map[string]string {
+	if len(script.Labels) == 0 {
+		return nil
+	}
+
+	data := labelTemplateData{Params: make(map[string]string, len(params))}
+	for key, values := range params {
+		data.Params[key] = strings.Join(values, ",")
+	}
+
+	labels := make(map[string]string, len(script.Labels))
+	for name, value := range script.Labels {
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(value)
+		if err != nil {
+			logger.Error("Error parsing label template", slog.String("script", script.Name), slog.String("label", name), slog.Any("error", err))
+			continue
+		}
+
+		var rendered strings.Builder
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			logger.Error("Error rendering label template", slog.String("script", script.Name), slog.String("label", name), slog.Any("error", err))
+			continue
+		}
+
+		if rendered.Len() > 0 {
+			labels[name] = rendered.String()
+		}
+	}
+
+	return labels
+}
+
+// addLabels adds the provided labels to all metrics of the provided metric
+// families. Existing labels with the same name are overwritten. The metric
+// families are not modified, instead new metric families are returned, because
+// the provided metric families might also be referenced by the cache.
+func addLabels(metricFamilies []*dto.MetricFamily, labels map[string]string) []*dto.MetricFamily {
+	if len(labels) == 0 {
+		return metricFamilies
+	}
+
+	labeledMetricFamilies := make([]*dto.MetricFamily, 0, len(metricFamilies))
+
+	for _, metricFamily := range metricFamilies {
+		labeledMetricFamily := &dto.MetricFamily{
+			Name:   metricFamily.Name,
+			Help:   metricFamily.Help,
+			Type:   metricFamily.Type,
+			Unit:   metricFamily.Unit,
+			Metric: make([]*dto.Metric, 0, len(metricFamily.GetMetric())),
+		}
+
+		for _, metric := range metricFamily.GetMetric() {
+			labeledMetric := proto.Clone(metric).(*dto.Metric)
+			labeledMetric.Label = slices.DeleteFunc(labeledMetric.Label, func(label *dto.LabelPair) bool {
+				_, ok := labels[label.GetName()]
+				return ok
+			})
+			for name, value := range labels {
+				labeledMetric.Label = append(labeledMetric.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+			}
+			slices.SortFunc(labeledMetric.Label, func(a, b *dto.LabelPair) int {
+				return strings.Compare(a.GetName(), b.GetName())
+			})
+
+			labeledMetricFamily.Metric = append(labeledMetricFamily.Metric, labeledMetric)
+		}
+
+		labeledMetricFamilies = append(labeledMetricFamilies, labeledMetricFamily)
+	}
+
+	return labeledMetricFamilies
+}
@@ -0,0 +1,158 @@
+package prober
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var errQueueFull = errors.New("too many concurrent script executions")
+
+var (
+	metricQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "script_exporter",
+		Name:      "queue_depth",
+		Help:      "Number of script executions waiting for a free execution slot, partitioned by script.",
+	}, []string{"script"})
+	metricQueueRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "queue_rejected_total",
+		Help:      "Number of script executions rejected because the queue was full, partitioned by script.",
+	}, []string{"script"})
+)
+
+var globalLimiter *limiter
+var scriptLimiters map[string]*limiter
+var limiterLock = sync.Mutex{}
+
+// limiter limits the number of concurrent script executions. If all execution
+// slots are used, up to queueSize executions can wait for a free slot.
+type limiter struct {
+	maxConcurrency int
+	queueSize      int
+	slots          chan struct{}
+	queued         atomic.Int64
+}
+
+func newLimiter(maxConcurrency, queueSize int) *limiter {
+	return &limiter{
+		maxConcurrency: maxConcurrency,
+		queueSize:      queueSize,
+		slots:          make(chan struct{}, maxConcurrency),
+	}
+}
+
+// acquire acquires an execution slot. If no slot is free and the queue is not
+// full, it waits until a slot is free or the provided context is done. If the
+// queue is full, errQueueFull is returned, except wait is true, then it also
+// waits for a free slot.
+func (l *limiter) acquire(ctx context.Context, scriptName string, wait bool) (func(), error) {
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if l.queued.Add(1) > int64(l.queueSize) && !wait {
+		l.queued.Add(-1)
+		return nil, errQueueFull
+	}
+	defer l.queued.Add(-1)
+
+	metricQueueDepth.WithLabelValues(scriptName).Inc()
+	defer metricQueueDepth.WithLabelValues(scriptName).Dec()
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SetMaxConcurrency sets the maximum number of scripts, which can be run at the
+// same time across all scripts and the number of script executions, which can
+// wait for a free execution slot. If maxConcurrency is 0, the number of
+// concurrent script executions is not limited.
+func SetMaxConcurrency(maxConcurrency, queueSize int) {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+
+	if maxConcurrency <= 0 {
+		globalLimiter = nil
+		return
+	}
+
+	globalLimiter = newLimiter(maxConcurrency, queueSize)
+}
+
+// getScriptLimiter returns the limiter for the provided script or nil if the
+// number of concurrent executions is not limited for the script. When the
+// limits of a script were changed in the configuration, a new limiter is
+// created.
+func getScriptLimiter(script *config.Script) *limiter {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+
+	if script.MaxConcurrency <= 0 {
+		delete(scriptLimiters, script.Name)
+		return nil
+	}
+
+	if scriptLimiters == nil {
+		scriptLimiters = make(map[string]*limiter)
+	}
+
+	l, ok := scriptLimiters[script.Name]
+	if !ok || l.maxConcurrency != script.MaxConcurrency || l.queueSize != script.Queue.Size {
+		l = newLimiter(script.MaxConcurrency, script.Queue.Size)
+		scriptLimiters[script.Name] = l
+	}
+
+	return l
+}
+
+// acquireExecutionSlot acquires an execution slot for the provided script from
+// the limiter of the script and from the global limiter. The slot of the
+// script is acquired first, so that a script which waits for a free slot of
+// the script doesn't block a global slot. The returned function must be called
+// to release the slots after the script was run.
+func acquireExecutionSlot(ctx context.Context, script *config.Script) (func(), error) {
+	wait := script.Queue.OnFull == "wait"
+
+	releaseScript := func() {}
+	if l := getScriptLimiter(script); l != nil {
+		release, err := l.acquire(ctx, script.Name, wait)
+		if err != nil {
+			return nil, err
+		}
+		releaseScript = release
+	}
+
+	limiterLock.Lock()
+	l := globalLimiter
+	limiterLock.Unlock()
+
+	if l != nil {
+		releaseGlobal, err := l.acquire(ctx, script.Name, wait)
+		if err != nil {
+			releaseScript()
+			return nil, err
+		}
+
+		return func() {
+			releaseGlobal()
+			releaseScript()
+		}, nil
+	}
+
+	return releaseScript, nil
+}
@@ -0,0 +1,106 @@
+//go:build darwin || linux
+
+package prober
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	"golang.org/x/sys/unix"
+)
+
+// setProcessGroup starts the command in its own process group. When the
+// context of the command is done, the kill signal (SIGTERM by default) is sent
+// to all processes in the group, so that also child processes of the script
+// (e.g. "sleep") are terminated. Processes which are still running after the
+// grace period are killed via SIGKILL. The returned function must be called
+// right after the command was waited for. If the script was terminated, it
+// kills the processes which are still running in the group, instead of waiting
+// for the end of the grace period, when the id of the group might already be
+// reused by other processes.
+func setProcessGroup(cmd *exec.Cmd, scriptName, killSignal string, gracePeriod time.Duration) func() {
+	signal := syscall.SIGTERM
+	if slices.Contains(config.KillSignals, killSignal) {
+		signal = unix.SignalNum(killSignal)
+	}
+
+	// The timer is only set in the cancel function, which always returns
+	// before cmd.Wait returns.
+	var killTimer *time.Timer
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+
+		if signal == syscall.SIGKILL || gracePeriod <= 0 {
+			return killProcessGroup(pgid, scriptName)
+		}
+
+		killTimer = time.AfterFunc(gracePeriod, func() {
+			//nolint:errcheck
+			killProcessGroup(pgid, scriptName)
+		})
+
+		if err := syscall.Kill(-pgid, signal); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+		return nil
+	}
+
+	// This isn't counted as force kill, because the remaining processes might
+	// already be terminating and are only not reaped yet.
+	return func() {
+		if killTimer != nil && killTimer.Stop() {
+			//nolint:errcheck
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// killProcessGroup kills all processes in the provided process group via
+// SIGKILL. If there was still a process running, the script is counted as
+// force killed.
+func killProcessGroup(pgid int, scriptName string) error {
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		return err
+	}
+
+	metricForceKilledTotal.WithLabelValues(scriptName).Inc()
+	return nil
+}
+
+// getProcessUsage returns the resource usage of the exited process of a script.
+// The maximum resident set size is reported in kilobytes on Linux and in bytes
+// on Darwin. On Linux it is at least the resident set size of the exporter,
+// when the script was started, because it is inherited from the exporter.
+func getProcessUsage(state *os.ProcessState) *processUsage {
+	if state == nil {
+		return nil
+	}
+
+	usage := &processUsage{
+		CPUUserSeconds:   state.UserTime().Seconds(),
+		CPUSystemSeconds: state.SystemTime().Seconds(),
+	}
+
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		usage.MaxRSSBytes = float64(rusage.Maxrss)
+		if runtime.GOOS == "linux" {
+			usage.MaxRSSBytes *= 1024
+		}
+		usage.VoluntaryContextSwitches = float64(rusage.Nvcsw)
+		usage.InvoluntaryContextSwitches = float64(rusage.Nivcsw)
+	}
+
+	return usage
+}
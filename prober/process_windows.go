@@ -0,0 +1,35 @@
+//go:build windows
+
+package prober
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// setProcessGroup only counts the killed scripts on Windows, where the kill
+// signal and the grace period are not supported and the script is killed
+// immediately when the context of the command is done.
+func setProcessGroup(cmd *exec.Cmd, scriptName, killSignal string, gracePeriod time.Duration) func() {
+	cmd.Cancel = func() error {
+		metricForceKilledTotal.WithLabelValues(scriptName).Inc()
+		return cmd.Process.Kill()
+	}
+
+	return func() {}
+}
+
+// getProcessUsage returns the CPU times of the exited process of a script. The
+// maximum resident set size and the number of context switches are not
+// available on Windows.
+func getProcessUsage(state *os.ProcessState) *processUsage {
+	if state == nil {
+		return nil
+	}
+
+	return &processUsage{
+		CPUUserSeconds:   state.UserTime().Seconds(),
+		CPUSystemSeconds: state.SystemTime().Seconds(),
+	}
+}
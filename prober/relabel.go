@@ -0,0 +1,151 @@
+package prober
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// relabelMetricFamilies applies the metric relabel configurations of a script
+// to the metric families from the output of the script. The metric families
+// are not modified, instead new metric families are returned, because the
+// provided metric families might also be referenced by the cache.
+//
+// Since the name of a metric can be changed via the "__name__" label, the
+// metrics are grouped into new metric families after they were relabeled. If
+// metrics with different types are ending up in the same metric family, only
+// the metrics with the type of the first metric are kept.
+func relabelMetricFamilies(script *config.Script, logger *slog.Logger, metricFamilies []*dto.MetricFamily) []*dto.MetricFamily {
+	if len(script.MetricRelabelConfigs) == 0 {
+		return metricFamilies
+	}
+
+	var relabeledMetricFamilies []*dto.MetricFamily
+	relabeledMetricFamiliesByName := make(map[string]*dto.MetricFamily)
+
+	for _, metricFamily := range metricFamilies {
+		for _, metric := range metricFamily.GetMetric() {
+			labels := make(map[string]string, len(metric.GetLabel())+1)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			labels[model.MetricNameLabel] = metricFamily.GetName()
+
+			labels, keep := relabel(labels, script.MetricRelabelConfigs)
+			if !keep || labels[model.MetricNameLabel] == "" {
+				continue
+			}
+
+			name := labels[model.MetricNameLabel]
+			delete(labels, model.MetricNameLabel)
+
+			relabeledMetricFamily, ok := relabeledMetricFamiliesByName[name]
+			if !ok {
+				relabeledMetricFamily = &dto.MetricFamily{
+					Name: proto.String(name),
+					Help: proto.String(metricFamily.GetHelp()),
+					Type: metricFamily.GetType().Enum(),
+				}
+				relabeledMetricFamiliesByName[name] = relabeledMetricFamily
+				relabeledMetricFamilies = append(relabeledMetricFamilies, relabeledMetricFamily)
+			}
+
+			if relabeledMetricFamily.GetType() != metricFamily.GetType() {
+				logger.Debug("Dropping relabeled metric with conflicting type", slog.String("script", script.Name), slog.String("metric", name), slog.String("type", metricFamily.GetType().String()))
+				continue
+			}
+
+			relabeledMetric := proto.Clone(metric).(*dto.Metric)
+			relabeledMetric.Label = make([]*dto.LabelPair, 0, len(labels))
+			for labelName, labelValue := range labels {
+				relabeledMetric.Label = append(relabeledMetric.Label, &dto.LabelPair{Name: proto.String(labelName), Value: proto.String(labelValue)})
+			}
+			slices.SortFunc(relabeledMetric.Label, func(a, b *dto.LabelPair) int {
+				return strings.Compare(a.GetName(), b.GetName())
+			})
+
+			relabeledMetricFamily.Metric = append(relabeledMetricFamily.Metric, relabeledMetric)
+		}
+	}
+
+	return relabeledMetricFamilies
+}
+
+// relabel applies the provided relabel configurations to the labels of a
+// metric. It returns the new labels and false if the metric should be dropped.
+// Labels with an empty value are removed, like it is done in Prometheus.
+func relabel(labels map[string]string, relabelConfigs []config.RelabelConfig) (map[string]string, bool) {
+	for _, relabelConfig := range relabelConfigs {
+		regex := relabelConfig.Regex
+		if regex.Regexp == nil {
+			regex = config.DefaultRelabelConfig.Regex
+		}
+
+		values := make([]string, 0, len(relabelConfig.SourceLabels))
+		for _, sourceLabel := range relabelConfig.SourceLabels {
+			values = append(values, labels[sourceLabel])
+		}
+		value := strings.Join(values, relabelConfig.Separator)
+
+		switch relabelConfig.Action {
+		case config.RelabelDrop:
+			if regex.MatchString(value) {
+				return nil, false
+			}
+		case config.RelabelKeep:
+			if !regex.MatchString(value) {
+				return nil, false
+			}
+		case config.RelabelLabelMap:
+			for labelName, labelValue := range maps.Clone(labels) {
+				if regex.MatchString(labelName) {
+					labels[regex.ReplaceAllString(labelName, relabelConfig.Replacement)] = labelValue
+				}
+			}
+		case config.RelabelLabelDrop:
+			for labelName := range labels {
+				if regex.MatchString(labelName) {
+					delete(labels, labelName)
+				}
+			}
+		case config.RelabelLabelKeep:
+			for labelName := range labels {
+				if labelName != model.MetricNameLabel && !regex.MatchString(labelName) {
+					delete(labels, labelName)
+				}
+			}
+		default:
+			indexes := regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				break
+			}
+
+			target := string(regex.ExpandString([]byte{}, relabelConfig.TargetLabel, value, indexes))
+			if !model.LabelName(target).IsValid() {
+				break
+			}
+
+			replacement := string(regex.ExpandString([]byte{}, relabelConfig.Replacement, value, indexes))
+			if replacement == "" {
+				delete(labels, target)
+				break
+			}
+			labels[target] = replacement
+		}
+	}
+
+	for labelName, labelValue := range labels {
+		if labelValue == "" {
+			delete(labels, labelName)
+		}
+	}
+
+	return labels, true
+}
@@ -0,0 +1,26 @@
+package prober
+
+// scriptUsage contains the resources, which were used by a single run of a
+// script.
+type scriptUsage struct {
+	process   *processUsage
+	resources *resourceUsage
+}
+
+// processUsage contains the resource usage of the process of a script, as
+// reported by the operating system after the process has exited. It also
+// contains the usage of child processes, which were waited for by the script.
+type processUsage struct {
+	CPUUserSeconds             float64 `json:"cpuUserSeconds"`
+	CPUSystemSeconds           float64 `json:"cpuSystemSeconds"`
+	MaxRSSBytes                float64 `json:"maxRSSBytes"`
+	VoluntaryContextSwitches   float64 `json:"voluntaryContextSwitches"`
+	InvoluntaryContextSwitches float64 `json:"involuntaryContextSwitches"`
+}
+
+// resourceUsage contains the resources, which were used by a script. It is
+// only set for scripts with resource limits.
+type resourceUsage struct {
+	MemoryPeakBytes float64 `json:"memoryPeakBytes"`
+	CPUSeconds      float64 `json:"cpuSeconds"`
+}
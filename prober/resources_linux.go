@@ -0,0 +1,381 @@
+//go:build linux
+
+package prober
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitForLimits is the shell command, which is executed instead of a script
+// with rlimits. It waits until the pipe, which is passed as file descriptor
+// (%[1]d), is closed by the exporter, after the rlimits were applied to the
+// shell process. Afterwards the script is executed in the same process, so that
+// the rlimits also apply to the script.
+const waitForLimits = `read -r _ <&%[1]d; exec %[1]d<&-; exec "$@"`
+
+// cgroupPeriod is the period in microseconds, which is used for the CPU quota
+// of a script.
+const cgroupPeriod = 100000
+
+// cgroupRoot is the cgroup, in which the cgroups for the scripts are created.
+// It is empty, as long as cgroup v2 wasn't set up. cgroupParent is the cgroup
+// of the exporter, before it was moved into the "exporter" child cgroup.
+var cgroupRoot string
+var cgroupParent string
+var cgroupLock = sync.RWMutex{}
+var cgroupSetupError string
+
+// rlimitFallbackWarnings contains the names of the scripts, for which a
+// warning was logged, that their limits are only approximated via setrlimit.
+var rlimitFallbackWarnings sync.Map
+
+// SetupResources prepares cgroup v2 for the resource limits of the scripts,
+// when a script in the provided configuration has a memory, CPU or pids limit.
+// It must be called, when the configuration is loaded or reloaded and before
+// the scripts of the configuration are run. The controllers for the child
+// cgroups can only be enabled, while no script is running in the cgroup of the
+// exporter, so that the setup can fail on a reload and is retried on the next
+// reload. As long as cgroup v2 can not be used, the limits of the scripts are
+// approximated via setrlimit.
+func SetupResources(c *config.Config, logger *slog.Logger) {
+	if !slices.ContainsFunc(c.Scripts, func(script config.Script) bool { return hasCgroupLimits(script.Resources) }) {
+		return
+	}
+
+	cgroupLock.Lock()
+	defer cgroupLock.Unlock()
+
+	if cgroupRoot != "" {
+		return
+	}
+
+	root, err := initCgroupRoot()
+	if err != nil {
+		// The warning is only logged once for the same error, so that a
+		// periodic reload of the configuration doesn't flood the logs.
+		if err.Error() != cgroupSetupError {
+			logger.Warn("Cgroup v2 can not be used, memory, CPU and pids limits of scripts are only approximated via setrlimit", slog.Any("error", err))
+		}
+		cgroupSetupError = err.Error()
+		return
+	}
+
+	cgroupRoot = root
+	cgroupSetupError = ""
+	logger.Info("Using cgroup v2 for resource limits", slog.String("cgroup", root))
+}
+
+// getCgroupRoot returns the cgroup, in which the cgroups for the scripts are
+// created, or an empty string, when cgroup v2 wasn't set up.
+func getCgroupRoot() string {
+	cgroupLock.RLock()
+	defer cgroupLock.RUnlock()
+
+	return cgroupRoot
+}
+
+// hasCgroupLimits returns true, when a resource limit is configured, which
+// requires a cgroup.
+func hasCgroupLimits(resources config.Resources) bool {
+	return resources.MemoryMax > 0 || resources.CPUQuota > 0 || resources.PidsMax > 0
+}
+
+// initCgroupRoot enables the memory, cpu and pids controllers for the children
+// of the cgroup of the exporter. Because cgroup v2 doesn't allow processes in a
+// cgroup, which enables controllers for its children, the exporter is moved
+// into the "exporter" child cgroup first. The cgroup of the exporter is only
+// read once, because the exporter is already moved into the child cgroup, when
+// a previous setup failed. The cgroup lock must be held by the caller.
+func initCgroupRoot() (string, error) {
+	if cgroupParent == "" {
+		data, err := os.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return "", err
+		}
+
+		for line := range strings.Lines(string(data)) {
+			if path, ok := strings.CutPrefix(strings.TrimSpace(line), "0::"); ok {
+				cgroupParent = filepath.Join("/sys/fs/cgroup", path)
+			}
+		}
+		if cgroupParent == "" {
+			return "", errors.New("cgroup v2 is not used")
+		}
+	}
+	root := cgroupParent
+
+	controllers, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	subtreeControl, err := os.ReadFile(filepath.Join(root, "cgroup.subtree_control"))
+	if err != nil {
+		return "", err
+	}
+
+	var enable []string
+	for _, controller := range []string{"memory", "cpu", "pids"} {
+		if !slices.Contains(strings.Fields(string(controllers)), controller) {
+			return "", fmt.Errorf("cgroup controller %s is not available", controller)
+		}
+		if !slices.Contains(strings.Fields(string(subtreeControl)), controller) {
+			enable = append(enable, "+"+controller)
+		}
+	}
+	if len(enable) == 0 {
+		return root, nil
+	}
+
+	exporterCgroup := filepath.Join(root, "exporter")
+	if err := os.Mkdir(exporterCgroup, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(exporterCgroup, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0o644); err != nil {
+		return "", err
+	}
+
+	return root, nil
+}
+
+// scriptResources applies the resource limits of a script to a single
+// execution of the script. If cgroup v2 can be used, the script is started in
+// a transient cgroup, which is removed after the script was run. Otherwise the
+// memory, CPU and pids limits are approximated via setrlimit. The maximum
+// number of open files is always applied via setrlimit. All rlimits are
+// applied before the script is executed.
+type scriptResources struct {
+	script  *config.Script
+	logger  *slog.Logger
+	cgroup  string
+	fd      *os.File
+	rlimits map[int]uint64
+	// waitReader and waitWriter are the ends of the pipe, which is used to
+	// start the script only after the rlimits were applied.
+	waitReader *os.File
+	waitWriter *os.File
+}
+
+func newScriptResources(script *config.Script, logger *slog.Logger, timeout float64) *scriptResources {
+	r := &scriptResources{script: script, logger: logger, rlimits: map[int]uint64{}}
+
+	if script.Resources.MaxOpenFiles > 0 {
+		r.rlimits[unix.RLIMIT_NOFILE] = script.Resources.MaxOpenFiles
+	}
+
+	if !hasCgroupLimits(script.Resources) {
+		return r
+	}
+
+	root := getCgroupRoot()
+	if root == "" {
+		if _, warned := rlimitFallbackWarnings.LoadOrStore(script.Name, true); !warned {
+			logger.Warn("Memory, CPU and pids limits of script are only approximated via setrlimit, because cgroup v2 is not used", slog.String("script", script.Name))
+		}
+
+		// The memory limit is applied to the address space of each process,
+		// the CPU quota is converted into the CPU time, which each process
+		// can use until the timeout is reached, and the pids limit is
+		// applied to the number of processes of the user.
+		if script.Resources.MemoryMax > 0 {
+			r.rlimits[unix.RLIMIT_AS] = uint64(script.Resources.MemoryMax)
+		}
+		if script.Resources.CPUQuota > 0 {
+			if timeout > 0 {
+				r.rlimits[unix.RLIMIT_CPU] = uint64(max(math.Ceil(script.Resources.CPUQuota*timeout), 1))
+			} else {
+				logger.Debug("CPU limit of script is not applied, because the script has no timeout", slog.String("script", script.Name))
+			}
+		}
+		if script.Resources.PidsMax > 0 {
+			r.rlimits[unix.RLIMIT_NPROC] = uint64(script.Resources.PidsMax)
+		}
+
+		return r
+	}
+
+	cgroup, err := os.MkdirTemp(root, "script-")
+	if err != nil {
+		logger.Error("Error creating cgroup for script", slog.String("script", script.Name), slog.Any("error", err))
+		return r
+	}
+	r.cgroup = cgroup
+
+	limits := map[string]string{}
+	if script.Resources.MemoryMax > 0 {
+		limits["memory.max"] = strconv.FormatInt(script.Resources.MemoryMax, 10)
+	}
+	if script.Resources.CPUQuota > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int64(script.Resources.CPUQuota*cgroupPeriod), cgroupPeriod)
+	}
+	if script.Resources.PidsMax > 0 {
+		limits["pids.max"] = strconv.FormatInt(script.Resources.PidsMax, 10)
+	}
+
+	for file, value := range limits {
+		if err := os.WriteFile(filepath.Join(cgroup, file), []byte(value), 0o644); err != nil {
+			logger.Error("Error setting resource limit for script", slog.String("script", script.Name), slog.String("limit", file), slog.Any("error", err))
+		}
+	}
+
+	fd, err := os.Open(cgroup)
+	if err != nil {
+		logger.Error("Error opening cgroup for script", slog.String("script", script.Name), slog.Any("error", err))
+		return r
+	}
+	r.fd = fd
+
+	return r
+}
+
+// prepare configures the command, so that the script is started in the cgroup.
+// If rlimits must be applied, a shell is started instead of the script, which
+// waits until the rlimits were applied by started and then executes the script.
+func (r *scriptResources) prepare(cmd *exec.Cmd) {
+	if len(r.rlimits) > 0 && cmd.Err == nil {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			r.logger.Error("Error creating pipe to apply resource limits", slog.String("script", r.script.Name), slog.Any("error", err))
+		} else {
+			r.waitReader = reader
+			r.waitWriter = writer
+
+			fd := 3 + len(cmd.ExtraFiles)
+			cmd.ExtraFiles = append(cmd.ExtraFiles, reader)
+			cmd.Args = append([]string{"sh", "-c", fmt.Sprintf(waitForLimits, fd), cmd.Args[0], cmd.Path}, cmd.Args[1:]...)
+			cmd.Path = "/bin/sh"
+		}
+	}
+
+	if r.fd == nil {
+		return
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(r.fd.Fd())
+}
+
+// started applies the rlimits to the started process and lets the process
+// continue with the execution of the script.
+func (r *scriptResources) started(pid int) {
+	if r.waitWriter == nil {
+		return
+	}
+
+	for resource, limit := range r.rlimits {
+		if err := unix.Prlimit(pid, resource, &unix.Rlimit{Cur: limit, Max: limit}, nil); err != nil {
+			r.logger.Error("Error setting resource limit for script", slog.String("script", r.script.Name), slog.Int("resource", resource), slog.Any("error", err))
+		}
+	}
+
+	r.closeWaitPipe()
+}
+
+func (r *scriptResources) closeWaitPipe() {
+	if r.waitReader != nil {
+		r.waitReader.Close()
+		r.waitReader = nil
+	}
+	if r.waitWriter != nil {
+		r.waitWriter.Close()
+		r.waitWriter = nil
+	}
+}
+
+// memoryPeak returns the peak memory usage of the cgroup of the script. The
+// second return value is false, when the script wasn't run in a cgroup.
+func (r *scriptResources) memoryPeak() (float64, bool) {
+	if r.fd == nil {
+		return 0, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(r.cgroup, "memory.peak"))
+	if err != nil {
+		return 0, false
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return value, true
+}
+
+// usage returns the peak memory and the CPU time of the script. If the script
+// was run in a cgroup, the values of the cgroup are used, which also contain
+// all child processes. Otherwise the resource usage of the process is used.
+func (r *scriptResources) usage(state *os.ProcessState) *resourceUsage {
+	if r.fd != nil {
+		usage := &resourceUsage{}
+		usage.MemoryPeakBytes, _ = r.memoryPeak()
+
+		if data, err := os.ReadFile(filepath.Join(r.cgroup, "cpu.stat")); err == nil {
+			for line := range strings.Lines(string(data)) {
+				if value, ok := strings.CutPrefix(strings.TrimSpace(line), "usage_usec "); ok {
+					if usec, err := strconv.ParseFloat(value, 64); err == nil {
+						usage.CPUSeconds = usec / 1e6
+					}
+				}
+			}
+		}
+
+		return usage
+	}
+
+	usage := getProcessUsage(state)
+	if usage == nil {
+		return nil
+	}
+
+	return &resourceUsage{
+		MemoryPeakBytes: usage.MaxRSSBytes,
+		CPUSeconds:      usage.CPUUserSeconds + usage.CPUSystemSeconds,
+	}
+}
+
+// close kills all processes, which are still running in the cgroup and removes
+// the cgroup.
+func (r *scriptResources) close() {
+	r.closeWaitPipe()
+	if r.fd != nil {
+		r.fd.Close()
+	}
+	if r.cgroup == "" {
+		return
+	}
+
+	//nolint:errcheck
+	os.WriteFile(filepath.Join(r.cgroup, "cgroup.kill"), []byte("1"), 0o644)
+
+	// The cgroup can only be removed, when all killed processes have exited.
+	for range 10 {
+		if err := os.Remove(r.cgroup); err == nil || !errors.Is(err, syscall.EBUSY) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r.logger.Warn("Error removing cgroup of script", slog.String("script", r.script.Name), slog.String("cgroup", r.cgroup))
+}
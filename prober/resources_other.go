@@ -0,0 +1,44 @@
+//go:build darwin || windows
+
+package prober
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/ricoberger/script_exporter/config"
+)
+
+var resourcesWarningOnce sync.Once
+
+// SetupResources is a no-op on Darwin and Windows, where the resource limits of
+// a script are not supported.
+func SetupResources(c *config.Config, logger *slog.Logger) {}
+
+// scriptResources is a no-op on Darwin and Windows, where the resource limits
+// of a script are not supported.
+type scriptResources struct{}
+
+func newScriptResources(script *config.Script, logger *slog.Logger, timeout float64) *scriptResources {
+	resourcesWarningOnce.Do(func() {
+		logger.Warn("Resource limits for scripts are only supported on Linux", slog.String("script", script.Name))
+	})
+
+	return &scriptResources{}
+}
+
+func (r *scriptResources) prepare(cmd *exec.Cmd) {}
+
+func (r *scriptResources) started(pid int) {}
+
+func (r *scriptResources) memoryPeak() (float64, bool) {
+	return 0, false
+}
+
+func (r *scriptResources) usage(state *os.ProcessState) *resourceUsage {
+	return nil
+}
+
+func (r *scriptResources) close() {}
@@ -0,0 +1,280 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricoberger/script_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var schedules map[string]*schedule
+var scheduleLock = sync.RWMutex{}
+
+var (
+	metricScheduleOverrunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "script_exporter",
+		Name:      "schedule_overruns_total",
+		Help:      "Number of scheduled script runs which took longer than the interval of the schedule, partitioned by script.",
+	}, []string{"script"})
+)
+
+// schedule runs a script with a single set of parameters in the background.
+// The result of the last run is kept, so that it can be returned by a probe
+// for the script and parameters, instead of running the script again. The
+// result is only used until it expires, so that a schedule which stopped
+// producing new results doesn't serve an old result forever.
+type schedule struct {
+	script     config.Script
+	params     url.Values
+	cancel     context.CancelFunc
+	result     *scriptResult
+	resultTime time.Time
+}
+
+// getScheduleKey returns the key for the schedule of a script with the
+// provided parameters. The "script" parameter is ignored, so that the result of
+// a schedule can also be used when multiple scripts are requested in a single
+// probe.
+func getScheduleKey(scriptName string, params url.Values) string {
+	keyParams := make(url.Values, len(params))
+	for key, values := range params {
+		if key != "script" {
+			keyParams[key] = values
+		}
+	}
+
+	return scriptName + "?" + keyParams.Encode()
+}
+
+// getScheduleJitter returns a random duration between 0 and the configured
+// jitter of a schedule.
+func getScheduleJitter(jitter float64) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+
+	//nolint:gosec
+	return time.Duration(rand.Float64() * jitter * float64(time.Second))
+}
+
+// getScheduleExpiry returns the duration after which the result of a scheduled
+// run expires. This is twice the interval plus the jitter, so that a single
+// late or rejected run doesn't expire the result.
+func getScheduleExpiry(schedule config.Schedule) time.Duration {
+	return time.Duration(2 * (schedule.Interval + schedule.Jitter) * float64(time.Second))
+}
+
+// isExpired returns true if the schedule has no result or if the result of the
+// last run is expired. The caller must hold the scheduleLock.
+func (s *schedule) isExpired() bool {
+	return s.result == nil || time.Since(s.resultTime) > getScheduleExpiry(s.script.Schedule)
+}
+
+// UpdateSchedules starts the background runs for all scripts with a schedule
+// in the provided configuration. Schedules which are not part of the
+// configuration anymore are stopped. Schedules for scripts with an unchanged
+// configuration keep running, so that a configuration reload does not trigger
+// a new run of all scheduled scripts.
+func UpdateSchedules(c *config.Config, logger *slog.Logger, logEnv bool, scriptTimeoutOffset float64, scriptNoArgs bool) {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	if schedules == nil {
+		schedules = make(map[string]*schedule)
+	}
+
+	activeSchedules := make(map[string]bool)
+
+	for _, script := range c.Scripts {
+		if script.Schedule.Interval <= 0 {
+			continue
+		}
+
+		paramSets := script.Schedule.Params
+		if len(paramSets) == 0 {
+			paramSets = []map[string]string{nil}
+		}
+
+		for _, paramSet := range paramSets {
+			params := url.Values{}
+			for key, value := range paramSet {
+				params.Set(key, value)
+			}
+			params.Set("script", script.Name)
+
+			key := getScheduleKey(script.Name, params)
+			activeSchedules[key] = true
+
+			if existingSchedule, ok := schedules[key]; ok {
+				if reflect.DeepEqual(existingSchedule.script, script) {
+					continue
+				}
+				existingSchedule.cancel()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			s := &schedule{script: script, params: params, cancel: cancel}
+			schedules[key] = s
+
+			logger.Debug("Starting schedule", slog.String("script", script.Name), slog.String("params", params.Encode()))
+			go s.run(ctx, logger, logEnv, scriptTimeoutOffset, scriptNoArgs)
+		}
+	}
+
+	for key, s := range schedules {
+		if !activeSchedules[key] {
+			logger.Debug("Stopping schedule", slog.String("script", s.script.Name), slog.String("params", s.params.Encode()))
+			s.cancel()
+			delete(schedules, key)
+		}
+	}
+}
+
+// run runs the script of the schedule until the provided context is canceled.
+// The first run is started after a random jitter, so that not all scheduled
+// scripts are started at the same time.
+func (s *schedule) run(ctx context.Context, logger *slog.Logger, logEnv bool, scriptTimeoutOffset float64, scriptNoArgs bool) {
+	timer := time.NewTimer(getScheduleJitter(s.script.Schedule.Jitter))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		start := time.Now()
+		result := handleScript(ctx, &s.script, s.params, logger, logEnv, "", scriptTimeoutOffset, scriptNoArgs)
+		addHistoryEntry(&s.script, s.params, result)
+
+		// A rejected run doesn't replace the result of the last run, so that
+		// probes are still served when the execution slots are exhausted.
+		if !result.rejected {
+			scheduleLock.Lock()
+			s.result = &result
+			s.resultTime = time.Now()
+			scheduleLock.Unlock()
+		}
+
+		// The next run is only started after the current run has finished, so
+		// a run which takes longer than the interval delays all following runs.
+		if duration := time.Since(start); duration > time.Duration(s.script.Schedule.Interval*float64(time.Second)) {
+			logger.Warn("Scheduled script run took longer than the interval", slog.String("script", s.script.Name), slog.Duration("duration", duration), slog.Float64("interval", s.script.Schedule.Interval))
+			metricScheduleOverrunsTotal.WithLabelValues(s.script.Name).Inc()
+		}
+
+		logger.Debug("Scheduled script was run", slog.String("script", s.script.Name), slog.Float64("duration", result.duration))
+		timer.Reset(time.Duration(s.script.Schedule.Interval*float64(time.Second)) + getScheduleJitter(s.script.Schedule.Jitter))
+	}
+}
+
+// getScheduleResult returns the result of the last run of the schedule for the
+// provided script and parameters. If the script is not scheduled with these
+// parameters or if the result is missing or expired, nil is returned. Like a
+// result from the cache, the returned result is marked as cached, so that the
+// age of the result is visible via the "script_cache_age_seconds" metric.
+func getScheduleResult(script *config.Script, params url.Values) *scriptResult {
+	scheduleLock.RLock()
+	defer scheduleLock.RUnlock()
+
+	if s, ok := schedules[getScheduleKey(script.Name, params)]; ok && !s.isExpired() {
+		result := *s.result
+		result.startTime = time.Now()
+		result.duration = 0
+		result.cached = 1
+		return &result
+	}
+
+	return nil
+}
+
+// scheduleCollector is a prometheus.Collector, which returns the metrics for
+// the last run of all scheduled scripts, where the "expose_metrics" option is
+// enabled. This allows to serve the metrics of these scripts via the "/metrics"
+// endpoint of the exporter, without a separate probe.
+type scheduleCollector struct {
+	logger *slog.Logger
+}
+
+// NewScheduleCollector returns a new collector for the results of scheduled
+// scripts, which should be registered in the default registry.
+func NewScheduleCollector(logger *slog.Logger) prometheus.Collector {
+	return &scheduleCollector{logger: logger}
+}
+
+// Describe implements the prometheus.Collector interface. Like the collector
+// for probes, it doesn't send any descriptors, because the metrics returned by
+// the scripts are not known in advance.
+func (c *scheduleCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements the prometheus.Collector interface. The schedules are
+// copied before the metrics are generated, so that the lock is not held while
+// the metrics are sent to the channel. Each series is only sent once, because
+// a duplicated series would fail the whole "/metrics" endpoint.
+func (c *scheduleCollector) Collect(ch chan<- prometheus.Metric) {
+	scheduleLock.RLock()
+	var exposedSchedules []schedule
+	for _, s := range schedules {
+		if s.script.Schedule.ExposeMetrics && !s.isExpired() {
+			exposedSchedules = append(exposedSchedules, *s)
+		}
+	}
+	scheduleLock.RUnlock()
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		defer close(metrics)
+
+		helps := make(map[string]string)
+		for _, s := range exposedSchedules {
+			labels := renderLabels(&s.script, c.logger, s.params)
+			outputMetricFamilies := normalizeHelp(getOutputMetricFamilies(&s.script, c.logger, *s.result, labels), helps)
+			generateScriptMetrics(metrics, &s.script, *s.result, labels, outputMetricFamilies)
+		}
+	}()
+
+	series := make(map[string]bool)
+	for metric := range metrics {
+		key, err := getSeriesKey(metric)
+		if err != nil {
+			c.logger.Warn("Dropping invalid metric of scheduled script", slog.String("metric", metric.Desc().String()), slog.Any("error", err))
+			continue
+		}
+		if series[key] {
+			c.logger.Warn("Dropping duplicated metric of scheduled script", slog.String("metric", key))
+			continue
+		}
+
+		series[key] = true
+		ch <- metric
+	}
+}
+
+// getSeriesKey returns a key for the series of a metric, which contains the
+// descriptor and all label pairs of the metric.
+func getSeriesKey(metric prometheus.Metric) (string, error) {
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		return "", err
+	}
+
+	var key strings.Builder
+	key.WriteString(metric.Desc().String())
+	for _, label := range m.GetLabel() {
+		fmt.Fprintf(&key, " %s=%q", label.GetName(), label.GetValue())
+	}
+
+	return key.String(), nil
+}
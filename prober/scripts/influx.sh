@@ -0,0 +1,5 @@
+#!/usr/bin/env bash
+
+echo 'weather,location=us-midwest temperature=82,humidity=71i 1465839830100400200'
+echo 'weather,location=us-east temperature=75,humidity=64i,condition="sunny" 1465839830100400200'
+echo 'invalid line'
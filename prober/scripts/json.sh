@@ -0,0 +1,14 @@
+#!/usr/bin/env bash
+
+cat <<JSON
+{
+  "counter": 1234,
+  "timestamp": 1657568506,
+  "values": [
+    {"id": "id-A", "count": 1, "state": "ACTIVE"},
+    {"id": "id-B", "count": 2, "state": "INACTIVE"},
+    {"id": "id-C", "count": 3, "state": "ACTIVE"}
+  ],
+  "location": "mars"
+}
+JSON